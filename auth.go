@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	ScopeOperator = "operator" // registering, migrating, and inspecting processes
+	ScopePeer     = "peer"     // traffic and checkpoints sent between nodes
+	ScopeMetrics  = "metrics"  // reading /metrics, and nothing else
+)
+
+// bearerTransport adds this node's peer token to every request it sends
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+var (
+	// maps each accepted token to its scope; empty when auth is disabled
+	tokenScopes map[string]string
+
+	// the scopes whose endpoints each scope's token may call. Operators can
+	// already see everything /metrics reports.
+	scopeGrants = map[string][]string{
+		ScopeOperator: {ScopeOperator, ScopeMetrics},
+		ScopePeer:     {ScopePeer},
+		ScopeMetrics:  {ScopeMetrics},
+	}
+)
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request
+	authed := r.Clone(r.Context())
+	authed.Header.Set("Authorization", "Bearer "+t.token)
+
+	return t.base.RoundTrip(authed)
+}
+
+// setupAuth requires operatorToken on operator endpoints and peerToken on
+// peer endpoints. Every node in a cluster shares peerToken, and presents it
+// when contacting the others. metricsToken, if set, lets a scraper read
+// /metrics without being able to do anything else.
+func setupAuth(operatorToken, peerToken, metricsToken string) {
+	tokenScopes = map[string]string{
+		operatorToken: ScopeOperator,
+		peerToken:     ScopePeer,
+	}
+	if metricsToken != "" {
+		tokenScopes[metricsToken] = ScopeMetrics
+	}
+
+	base := peerClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	peerClient = &http.Client{Transport: bearerTransport{token: peerToken, base: base}}
+}
+
+// requireScope rejects requests without a known bearer token with 401, and
+// requests whose token doesn't grant scope with 403. Without auth every
+// request passes.
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(tokenScopes) == 0 {
+			handler(w, r)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		presented := strings.TrimPrefix(header, "Bearer ")
+
+		var found string
+		for token, tokenScope := range tokenScopes {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(presented)) == 1 {
+				found = tokenScope
+			}
+		}
+
+		if found == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		for _, granted := range scopeGrants[found] {
+			if granted == scope {
+				handler(w, r)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
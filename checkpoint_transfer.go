@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CheckpointChunkSize      = 4 << 20  // bytes per uploaded chunk
+	CheckpointMaxChunkSize   = 64 << 20 // largest chunk a destination will accept
+	CheckpointUploadAttempts = 5        // times the source resumes an interrupted upload
+)
+
+// CheckpointManifest describes an archive before any of it is uploaded, so
+// the destination can verify each chunk and the whole
+type CheckpointManifest struct {
+	Size      int64    // bytes in the archive
+	ChunkSize int64    // bytes per chunk; the last chunk may be shorter
+	Chunks    []string // hex SHA-256 of each chunk
+	SHA256    string   // hex SHA-256 of the whole archive
+}
+
+// CheckpointStatus tells the source which chunks the destination still needs
+type CheckpointStatus struct {
+	Missing []int
+}
+
+// checkpointUpload is the destination's view of an archive being received
+type checkpointUpload struct {
+	manifest CheckpointManifest
+	received []bool
+	m        sync.Mutex
+}
+
+var (
+	// maps an archive path to the *checkpointUpload receiving it
+	CheckpointUploads *sync.Map = new(sync.Map)
+)
+
+// chunkSize is the length of chunk i of an archive described by m
+func (m CheckpointManifest) chunkSize(i int) int64 {
+	if rest := m.Size - int64(i)*m.ChunkSize; rest < m.ChunkSize {
+		return rest
+	}
+
+	return m.ChunkSize
+}
+
+func (m CheckpointManifest) validate() error {
+	if m.Size < 0 || m.ChunkSize <= 0 || m.ChunkSize > CheckpointMaxChunkSize {
+		return errors.New("manifest has a bad size")
+	}
+
+	expected := (m.Size + m.ChunkSize - 1) / m.ChunkSize
+	if int64(len(m.Chunks)) != expected {
+		return fmt.Errorf("manifest lists %d chunks, expected %d", len(m.Chunks), expected)
+	}
+
+	return nil
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildManifest hashes the archive at path chunk by chunk
+func buildManifest(path string) (CheckpointManifest, error) {
+	manifest := CheckpointManifest{ChunkSize: CheckpointChunkSize}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return manifest, err
+	}
+	defer file.Close()
+
+	whole := sha256.New()
+	chunk := make([]byte, CheckpointChunkSize)
+	for {
+		n, err := io.ReadFull(file, chunk)
+		if n > 0 {
+			whole.Write(chunk[:n])
+			manifest.Chunks = append(manifest.Chunks, hashBytes(chunk[:n]))
+			manifest.Size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return manifest, err
+		}
+	}
+
+	manifest.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return manifest, nil
+}
+
+// uploadCheckpoint sends the archive at path to target in chunks, resuming
+// from whatever the destination already holds if the transfer is interrupted.
+// query identifies the image set. Cancelling ctx abandons the upload. progress
+// is told how many bytes the destination holds after each chunk.
+func uploadCheckpoint(ctx context.Context, log *logrus.Entry, target string, query url.Values,
+	path string, progress func(uploaded int64)) error {
+	manifest, err := buildManifest(path)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = uploadMissingChunks(ctx, target, query, path, manifest, progress)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		if attempt == CheckpointUploadAttempts {
+			return err
+		}
+
+		log.WithError(err).WithFields(logrus.Fields{"archive": path, "attempt": attempt}).
+			Warn("upload interrupted, resuming")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+// commitUpload asks target to verify an uploaded image set and act on it.
+// query identifies the image set and carries the destination's instructions.
+func commitUpload(ctx context.Context, target string, query url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		peerURL(target, "/CommitCheckpoint?"+query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return responseError(res)
+}
+
+func uploadMissingChunks(ctx context.Context, target string, query url.Values, path string,
+	manifest CheckpointManifest, progress func(uploaded int64)) error {
+	jsonBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		peerURL(target, "/Checkpoints?"+query.Encode()), bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := responseError(res); err != nil {
+		return err
+	}
+
+	var status CheckpointStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	uploaded := manifest.Size
+	for _, i := range status.Missing {
+		if i < 0 || i >= len(manifest.Chunks) {
+			return fmt.Errorf("destination asked for nonexistent chunk %d", i)
+		}
+		uploaded -= manifest.chunkSize(i)
+	}
+
+	for _, i := range status.Missing {
+		chunkQuery := url.Values{}
+		for k, v := range query {
+			chunkQuery[k] = v
+		}
+		chunkQuery.Set("index", strconv.Itoa(i))
+
+		chunk := io.NewSectionReader(file, int64(i)*manifest.ChunkSize, manifest.chunkSize(i))
+		req, err := http.NewRequestWithContext(ctx, "PUT",
+			peerURL(target, "/CheckpointChunks?"+chunkQuery.Encode()), chunk)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "binary/octet-stream")
+
+		res, err := peerClient.Do(req)
+		if err != nil {
+			return err
+		}
+		err = responseError(res)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		uploaded += manifest.chunkSize(i)
+		progress(uploaded)
+	}
+
+	return nil
+}
+
+// responseError turns a non-200 response into an error carrying the
+// destination's explanation
+func responseError(res *http.Response) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("destination responded %s: %s", res.Status, bytes.TrimSpace(msg))
+}
+
+// startCheckpointUpload prepares to receive the archive described by
+// manifest. Chunks already on disk from an interrupted upload are kept.
+func startCheckpointUpload(id, images string, manifest CheckpointManifest) (CheckpointStatus, error) {
+	var status CheckpointStatus
+
+	if err := manifest.validate(); err != nil {
+		return status, err
+	}
+
+	path := checkpointArchive(id, images)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return status, err
+	}
+	defer file.Close()
+
+	upload := &checkpointUpload{
+		manifest: manifest,
+		received: make([]bool, len(manifest.Chunks)),
+	}
+
+	chunk := make([]byte, manifest.ChunkSize)
+	for i := range manifest.Chunks {
+		size := manifest.chunkSize(i)
+		n, _ := file.ReadAt(chunk[:size], int64(i)*manifest.ChunkSize)
+		if int64(n) == size && hashBytes(chunk[:size]) == manifest.Chunks[i] {
+			upload.received[i] = true
+		} else {
+			status.Missing = append(status.Missing, i)
+		}
+	}
+
+	if err := file.Truncate(manifest.Size); err != nil {
+		return status, err
+	}
+
+	CheckpointUploads.Store(path, upload)
+	return status, nil
+}
+
+// receiveCheckpointChunk verifies chunk index of an upload and writes it into
+// place
+func receiveCheckpointChunk(id, images string, index int, body io.Reader) error {
+	path := checkpointArchive(id, images)
+	iupload, ok := CheckpointUploads.Load(path)
+	if !ok {
+		return errors.New("no manifest for this checkpoint")
+	}
+
+	upload, ok := iupload.(*checkpointUpload)
+	if !ok {
+		return errors.New("checkpoint not associated with *checkpointUpload")
+	}
+
+	if index < 0 || index >= len(upload.manifest.Chunks) {
+		return fmt.Errorf("chunk %d out of range", index)
+	}
+
+	size := upload.manifest.chunkSize(index)
+	chunk, err := ioutil.ReadAll(io.LimitReader(body, size+1))
+	if err != nil {
+		return err
+	}
+
+	if int64(len(chunk)) != size {
+		return fmt.Errorf("chunk %d is %d bytes, expected %d", index, len(chunk), size)
+	}
+
+	if hashBytes(chunk) != upload.manifest.Chunks[index] {
+		return fmt.Errorf("chunk %d failed its checksum", index)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(chunk, int64(index)*upload.manifest.ChunkSize); err != nil {
+		return err
+	}
+
+	upload.m.Lock()
+	upload.received[index] = true
+	upload.m.Unlock()
+
+	return nil
+}
+
+// commitCheckpoint checks that every chunk of an upload arrived and that the
+// archive as a whole matches its manifest
+func commitCheckpoint(id, images string) error {
+	path := checkpointArchive(id, images)
+	iupload, ok := CheckpointUploads.Load(path)
+	if !ok {
+		return errors.New("no manifest for this checkpoint")
+	}
+
+	upload, ok := iupload.(*checkpointUpload)
+	if !ok {
+		return errors.New("checkpoint not associated with *checkpointUpload")
+	}
+
+	upload.m.Lock()
+	for i, received := range upload.received {
+		if !received {
+			upload.m.Unlock()
+			return fmt.Errorf("chunk %d never arrived", i)
+		}
+	}
+	upload.m.Unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	whole := sha256.New()
+	if _, err := io.Copy(whole, file); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(whole.Sum(nil)) != upload.manifest.SHA256 {
+		return errors.New("archive failed its checksum")
+	}
+
+	CheckpointUploads.Delete(path)
+	return nil
+}
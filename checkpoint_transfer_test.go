@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mholt/archiver"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testChunkSize = 1024
+
+// setupCheckpointTest points the image directory somewhere temporary and
+// announces an incoming migration to upload into. The returned function undoes
+// both.
+func setupCheckpointTest(t *testing.T, id string) func() {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "checkpoint-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageDir := nodeConfig.ImageDir
+	nodeConfig.ImageDir = dir
+	IncomingMigrations.Store(id, &incomingMigration{migrationID: id, source: "source"})
+
+	return func() {
+		IncomingMigrations.Delete(id)
+		CheckpointUploads.Range(func(k, _ interface{}) bool {
+			CheckpointUploads.Delete(k)
+			return true
+		})
+		nodeConfig.ImageDir = imageDir
+		os.RemoveAll(dir)
+	}
+}
+
+// testArchive archives a directory named images holding a file of incompressible
+// bytes, and returns the archive and the file's contents
+func testArchive(t *testing.T, images string) ([]byte, []byte) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "checkpoint-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pages := make([]byte, 5*testChunkSize)
+	rand.New(rand.NewSource(1)).Read(pages)
+
+	imageDir := filepath.Join(dir, images)
+	if err := os.Mkdir(imageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(imageDir, "pages-1.img"), pages, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := archiver.NewTarGz().Archive([]string{imageDir}, imageDir+".tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ioutil.ReadFile(imageDir + ".tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archive, pages
+}
+
+// testManifest describes archive the way buildManifest would, in small chunks
+func testManifest(archive []byte) CheckpointManifest {
+	manifest := CheckpointManifest{
+		Size:      int64(len(archive)),
+		ChunkSize: testChunkSize,
+		SHA256:    hashBytes(archive),
+	}
+
+	for start := 0; start < len(archive); start += testChunkSize {
+		end := start + testChunkSize
+		if end > len(archive) {
+			end = len(archive)
+		}
+		manifest.Chunks = append(manifest.Chunks, hashBytes(archive[start:end]))
+	}
+
+	return manifest
+}
+
+func testChunk(archive []byte, manifest CheckpointManifest, i int) []byte {
+	start := int64(i) * manifest.ChunkSize
+	return archive[start : start+manifest.chunkSize(i)]
+}
+
+func serveCheckpoint(handler http.HandlerFunc, method string, query url.Values,
+	body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/?"+query.Encode(), bytes.NewReader(body))
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+func postManifest(t *testing.T, query url.Values, manifest CheckpointManifest) []int {
+	t.Helper()
+
+	body, _ := json.Marshal(manifest)
+	res := serveCheckpoint(ReceiveCheckpointHandler, "POST", query, body)
+	if res.Code != http.StatusOK {
+		t.Fatalf("manifest rejected: %d %s", res.Code, res.Body)
+	}
+
+	var status CheckpointStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+
+	return status.Missing
+}
+
+func putChunk(query url.Values, index int, chunk []byte) *httptest.ResponseRecorder {
+	chunkQuery := url.Values{"index": {strconv.Itoa(index)}}
+	for k, v := range query {
+		chunkQuery[k] = v
+	}
+
+	return serveCheckpoint(CheckpointChunkHandler, "PUT", chunkQuery, chunk)
+}
+
+func TestCheckpointUploadResumes(t *testing.T) {
+	const id = "c0ffee"
+	defer setupCheckpointTest(t, id)()
+
+	archive, pages := testArchive(t, "predump-1")
+	manifest := testManifest(archive)
+	query := url.Values{"migration": {id}, "images": {"predump-1"}}
+
+	n := len(manifest.Chunks)
+	if n < 4 {
+		t.Fatalf("archive is only %d chunks", n)
+	}
+
+	var all []int
+	for i := 0; i < n; i++ {
+		all = append(all, i)
+	}
+	if missing := postManifest(t, query, manifest); !reflect.DeepEqual(missing, all) {
+		t.Fatalf("fresh upload is missing %v, want %v", missing, all)
+	}
+
+	// the connection drops halfway through
+	for i := 0; i < n/2; i++ {
+		if res := putChunk(query, i, testChunk(archive, manifest, i)); res.Code != http.StatusOK {
+			t.Fatalf("chunk %d rejected: %d %s", i, res.Code, res.Body)
+		}
+	}
+
+	if res := serveCheckpoint(CommitCheckpointHandler, "POST", query, nil); res.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("committed a partial upload: %d %s", res.Code, res.Body)
+	}
+
+	// the source resumes with the same manifest
+	if missing := postManifest(t, query, manifest); !reflect.DeepEqual(missing, all[n/2:]) {
+		t.Fatalf("resumed upload is missing %v, want %v", missing, all[n/2:])
+	}
+
+	corrupt := append([]byte{}, testChunk(archive, manifest, n/2)...)
+	corrupt[0] ^= 0xff
+	res := putChunk(query, n/2, corrupt)
+	if res.Code != http.StatusUnprocessableEntity || !strings.Contains(res.Body.String(), "failed its checksum") {
+		t.Fatalf("corrupted chunk got %d %s", res.Code, res.Body)
+	}
+
+	for i := n / 2; i < n; i++ {
+		if res := putChunk(query, i, testChunk(archive, manifest, i)); res.Code != http.StatusOK {
+			t.Fatalf("chunk %d rejected: %d %s", i, res.Code, res.Body)
+		}
+	}
+
+	query.Set("predump", "true")
+	if res := serveCheckpoint(CommitCheckpointHandler, "POST", query, nil); res.Code != http.StatusOK {
+		t.Fatalf("commit failed: %d %s", res.Code, res.Body)
+	}
+
+	unpacked, err := ioutil.ReadFile(filepath.Join(restoreDir(id), "predump-1", "pages-1.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unpacked, pages) {
+		t.Error("unpacked images differ from the source's")
+	}
+}
+
+func TestCheckpointChunkRejects(t *testing.T) {
+	const id = "c0ffee"
+	defer setupCheckpointTest(t, id)()
+
+	archive, _ := testArchive(t, "pages")
+	manifest := testManifest(archive)
+	query := url.Values{"migration": {id}, "images": {"pages"}}
+	postManifest(t, query, manifest)
+
+	last := len(manifest.Chunks) - 1
+	tests := []struct {
+		name  string
+		index int
+		chunk []byte
+	}{
+		{"short", 0, testChunk(archive, manifest, 0)[1:]},
+		{"long", last, append(append([]byte{}, testChunk(archive, manifest, last)...), 0)},
+		{"another chunk's bytes", 1, testChunk(archive, manifest, 0)},
+		{"out of range", last + 1, testChunk(archive, manifest, 0)},
+		{"negative", -1, testChunk(archive, manifest, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if res := putChunk(query, test.index, test.chunk); res.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got %d %s", res.Code, res.Body)
+			}
+		})
+	}
+}
+
+func TestCheckpointCommitChecksArchive(t *testing.T) {
+	const id = "c0ffee"
+	defer setupCheckpointTest(t, id)()
+
+	archive, _ := testArchive(t, "pages")
+	manifest := testManifest(archive)
+	manifest.SHA256 = hashBytes([]byte("something else"))
+	query := url.Values{"migration": {id}, "images": {"pages"}}
+
+	postManifest(t, query, manifest)
+	for i := range manifest.Chunks {
+		putChunk(query, i, testChunk(archive, manifest, i))
+	}
+
+	res := serveCheckpoint(CommitCheckpointHandler, "POST", query, nil)
+	if res.Code != http.StatusUnprocessableEntity || !strings.Contains(res.Body.String(), "archive failed its checksum") {
+		t.Errorf("commit got %d %s", res.Code, res.Body)
+	}
+}
+
+func TestCheckpointBadImageSet(t *testing.T) {
+	const id = "c0ffee"
+	defer setupCheckpointTest(t, id)()
+
+	manifest, _ := json.Marshal(CheckpointManifest{ChunkSize: testChunkSize})
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"unknown migration", url.Values{"migration": {"beef"}, "images": {"pages"}}},
+		{"no images", url.Values{"migration": {id}}},
+		{"parent directory", url.Values{"migration": {id}, "images": {".."}}},
+		{"nested path", url.Values{"migration": {id}, "images": {"../pages"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if res := serveCheckpoint(ReceiveCheckpointHandler, "POST", test.query, manifest); res.Code != http.StatusBadRequest {
+				t.Errorf("got %d %s", res.Code, res.Body)
+			}
+		})
+	}
+}
+
+func TestCheckpointManifestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest CheckpointManifest
+		ok       bool
+	}{
+		{"empty archive", CheckpointManifest{ChunkSize: 10}, true},
+		{"exact chunks", CheckpointManifest{Size: 20, ChunkSize: 10, Chunks: []string{"a", "b"}}, true},
+		{"short last chunk", CheckpointManifest{Size: 21, ChunkSize: 10, Chunks: []string{"a", "b", "c"}}, true},
+		{"too few chunks", CheckpointManifest{Size: 21, ChunkSize: 10, Chunks: []string{"a", "b"}}, false},
+		{"too many chunks", CheckpointManifest{Size: 20, ChunkSize: 10, Chunks: []string{"a", "b", "c"}}, false},
+		{"negative size", CheckpointManifest{Size: -1, ChunkSize: 10}, false},
+		{"no chunk size", CheckpointManifest{Size: 10, Chunks: []string{"a"}}, false},
+		{"oversized chunks", CheckpointManifest{Size: 10, ChunkSize: CheckpointMaxChunkSize + 1,
+			Chunks: []string{"a"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.manifest.validate(); (err == nil) != test.ok {
+				t.Errorf("validate() = %v", err)
+			}
+		})
+	}
+}
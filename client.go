@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// nodeClient drives a node's operator endpoints on behalf of the CLI
+type nodeClient struct {
+	node   string // host:port of the node
+	scheme string
+	token  string // operator token, if the node requires one
+	client *http.Client
+}
+
+// clientFlags adds the flags every client subcommand shares to flags. The
+// returned function builds a client from them once they have been parsed.
+func clientFlags(flags *flag.FlagSet) func() (*nodeClient, error) {
+	nodePtr := flags.String("node", "localhost:8080", "host:port of the node to talk to")
+	tokenPtr := flags.String("token", os.Getenv("HANDOFF_TOKEN"),
+		"operator token (defaults to $HANDOFF_TOKEN)")
+	caPtr := flags.String("tls-ca", "", "CA that signs the node's certificate (enables TLS)")
+	certPtr := flags.String("tls-cert", "", "client certificate, if the node wants one")
+	keyPtr := flags.String("tls-key", "", "private key for -tls-cert")
+
+	return func() (*nodeClient, error) {
+		c := &nodeClient{node: *nodePtr, scheme: "http", token: *tokenPtr, client: http.DefaultClient}
+
+		if (*certPtr != "" || *keyPtr != "") && *caPtr == "" {
+			return nil, errors.New("-tls-cert and -tls-key require -tls-ca")
+		}
+
+		if *caPtr == "" {
+			return c, nil
+		}
+
+		// tls.go
+		pool, err := loadCertPool(*caPtr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := &tls.Config{RootCAs: pool}
+		if *certPtr != "" || *keyPtr != "" {
+			cert, err := tls.LoadX509KeyPair(*certPtr, *keyPtr)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+
+		c.scheme = "https"
+		c.client = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		return c, nil
+	}
+}
+
+// do sends body, if any, as JSON to path and decodes the reply into out, if
+// it is non-nil
+func (c *nodeClient) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsonBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(jsonBytes)
+	}
+
+	req, err := http.NewRequest(method, c.scheme+"://"+c.node+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		if len(bytes.TrimSpace(msg)) == 0 {
+			return fmt.Errorf("node responded %s", res.Status)
+		}
+		return fmt.Errorf("node responded %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// parsePorts reads a comma-separated list of ports
+func parsePorts(list string) ([]uint16, error) {
+	ports := []uint16{}
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad port %q", field)
+		}
+		ports = append(ports, uint16(port))
+	}
+
+	return ports, nil
+}
+
+// exitOnError ends a client subcommand that failed
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// migrationID reads the one positional argument naming a migration
+func migrationID(flags *flag.FlagSet) string {
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: handoff %s [flags] <migration id>\n", flags.Name())
+		os.Exit(2)
+	}
+
+	return flags.Arg(0)
+}
+
+func registerCommand(args []string) {
+	flags := flag.NewFlagSet("register", flag.ExitOnError)
+	connect := clientFlags(flags)
+	pidPtr := flags.Int("pid", 0, "PID of the process to register")
+	tcpPtr := flags.String("tcp", "", "comma-separated TCP ports the process listens on")
+	udpPtr := flags.String("udp", "", "comma-separated UDP ports the process listens on")
+	flags.Parse(args)
+
+	if *pidPtr <= 0 {
+		exitOnError(errors.New("-pid is required"))
+	}
+
+	tcpPorts, err := parsePorts(*tcpPtr)
+	exitOnError(err)
+	udpPorts, err := parsePorts(*udpPtr)
+	exitOnError(err)
+
+	client, err := connect()
+	exitOnError(err)
+
+	request := Process{Pid: int32(*pidPtr), TcpPorts: tcpPorts, UdpPorts: udpPorts}
+	exitOnError(client.do("POST", "/RegisterProcess", request, nil))
+}
+
+func migrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	connect := clientFlags(flags)
+	pidPtr := flags.Int("pid", 0, "PID of a registered process")
+	toPtr := flags.String("to", "", "host:port of the destination node")
+	modePtr := flags.String("mode", MigrationModeFull, "full, precopy or postcopy")
+	streamPtr := flags.Bool("stream-pages", false,
+		"dump pages straight into the destination (full migrations only)")
+	flags.Parse(args)
+
+	if *pidPtr <= 0 {
+		exitOnError(errors.New("-pid is required"))
+	}
+
+	if *toPtr == "" {
+		exitOnError(errors.New("-to is required"))
+	}
+
+	client, err := connect()
+	exitOnError(err)
+
+	request := StartMigrationRequest{
+		Pid:         int32(*pidPtr),
+		Destination: *toPtr,
+		Source:      client.node,
+		Mode:        *modePtr,
+		StreamPages: *streamPtr,
+	}
+
+	var response StartMigrationResponse
+	exitOnError(client.do("POST", "/StartMigration", request, &response))
+
+	fmt.Println(response.ID)
+}
+
+func statusCommand(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	connect := clientFlags(flags)
+	flags.Parse(args)
+	id := migrationID(flags)
+
+	client, err := connect()
+	exitOnError(err)
+
+	var status MigrationStatus
+	exitOnError(client.do("GET", "/Migrations/"+id, nil, &status))
+
+	printStatus(status)
+}
+
+func listCommand(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	connect := clientFlags(flags)
+	flags.Parse(args)
+
+	client, err := connect()
+	exitOnError(err)
+
+	var statuses []MigrationStatus
+	exitOnError(client.do("GET", "/Migrations", nil, &statuses))
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tPID\tDESTINATION\tMODE\tSTATE\tSTARTED")
+	for _, status := range statuses {
+		mode := status.Mode
+		if mode == "" {
+			mode = MigrationModeFull
+		}
+
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\t%s\t%s\n", status.ID, status.Pid,
+			status.Destination, mode, status.State, status.Started.Format(time.RFC3339))
+	}
+	table.Flush()
+}
+
+func cancelCommand(args []string) {
+	flags := flag.NewFlagSet("cancel", flag.ExitOnError)
+	connect := clientFlags(flags)
+	flags.Parse(args)
+	id := migrationID(flags)
+
+	client, err := connect()
+	exitOnError(err)
+
+	// the migration rolls itself back at its next step, so this is the state
+	// it was in when the request arrived
+	var status MigrationStatus
+	exitOnError(client.do("DELETE", "/Migrations/"+id, nil, &status))
+
+	printStatus(status)
+}
+
+func addressesCommand(args []string) {
+	flags := flag.NewFlagSet("addresses", flag.ExitOnError)
+	connect := clientFlags(flags)
+	flags.Parse(args)
+
+	client, err := connect()
+	exitOnError(err)
+
+	var pool PoolStatus
+	exitOnError(client.do("GET", "/Addresses", nil, &pool))
+
+	for _, network := range pool.Networks {
+		fmt.Printf("network %s: %d of %d addresses free\n", network.Network, network.Free, network.Size)
+	}
+	if len(pool.Excluded) > 0 {
+		fmt.Printf("excluded: %s\n", strings.Join(pool.Excluded, ", "))
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "ADDRESS\tOWNER\tPID\tLINK\tSINCE")
+	for _, lease := range pool.Leases {
+		pid := "-"
+		if lease.Pid != 0 {
+			pid = strconv.Itoa(int(lease.Pid))
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", lease.Addr, lease.Owner, pid, lease.Link,
+			lease.Since.Format(time.RFC3339))
+	}
+	for addr, owner := range pool.Reservations {
+		if !leased(pool.Leases, addr) {
+			fmt.Fprintf(table, "%s\t%s\t-\t-\treserved\n", addr, owner)
+		}
+	}
+	table.Flush()
+}
+
+func leased(leases []Lease, addr string) bool {
+	for _, lease := range leases {
+		if lease.Addr == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+func printStatus(status MigrationStatus) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "ID:\t%s\n", status.ID)
+	fmt.Fprintf(table, "PID:\t%d\n", status.Pid)
+	fmt.Fprintf(table, "Destination:\t%s\n", status.Destination)
+	if status.Mode != "" {
+		fmt.Fprintf(table, "Mode:\t%s\n", status.Mode)
+	}
+	fmt.Fprintf(table, "State:\t%s\n", status.State)
+	if status.Error != "" {
+		fmt.Fprintf(table, "Error:\t%s\n", status.Error)
+	}
+	if status.Rollback != "" {
+		fmt.Fprintf(table, "Rollback:\t%s\n", status.Rollback)
+	}
+	if status.Cancelling != "" {
+		fmt.Fprintf(table, "Cancelling:\t%s\n", status.Cancelling)
+	}
+	fmt.Fprintf(table, "Started:\t%s\n", status.Started.Format(time.RFC3339))
+	fmt.Fprintf(table, "Updated:\t%s\n", status.Updated.Format(time.RFC3339))
+	if status.State == StateCommitted {
+		fmt.Fprintf(table, "Downtime:\t%s\n", status.Downtime)
+	}
+	table.Flush()
+}
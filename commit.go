@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	CommitAttempts = 5 // times the source asks a destination that doesn't answer to commit
+)
+
+// commitRefusedError is a destination's answer that it will not take over, so
+// the original can safely be resumed
+type commitRefusedError struct {
+	err error
+}
+
+func (e commitRefusedError) Error() string {
+	return e.err.Error()
+}
+
+var (
+	// maps the ID of each migration this node committed as the destination
+	// to the restored PID, so that a source that missed our reply can ask again
+	CommittedMigrations *sync.Map = new(sync.Map)
+
+	errNoMigration = errors.New("no such migration")
+)
+
+// commitMigration is the second phase of a handoff. The destination has
+// restored its copy of p and the original is frozen; once the destination
+// agrees to take over, the original is killed and forgotten. A
+// commitRefusedError means the destination declined and the original is
+// still intact. Any other error means we never learned what the destination
+// did, so neither copy may be resumed or killed.
+func commitMigration(migration *Migration, p Process, destination string) error {
+	for attempt := 1; ; attempt++ {
+		err := requestCommit(destination, migration.ID())
+		if err == nil {
+			break
+		}
+
+		if _, refused := err.(commitRefusedError); refused || attempt == CommitAttempts {
+			return err
+		}
+
+		// committing twice is harmless, so just ask again
+		migration.log().WithError(err).WithField("attempt", attempt).Warn("commit unanswered, retrying")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	// past this point the destination's copy is the only one, so there is
+	// nothing left to roll back to
+	if err := syscall.Kill(int(p.Pid), syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		migration.log().WithError(err).Error("unable to kill original")
+	}
+
+	// its namespace dies with it (ipam.go)
+	for _, lease := range addressPool.releasePid(p.Pid) {
+		Namespaces.Delete(lease.Link)
+		inventory.forget(ResourceLink, lease.Link)
+	}
+
+	Processes.Delete(p.Pid)
+	MigrationClocks.Delete(p.Pid)
+	saveState()
+
+	if err := migration.transition(StateCommitted); err != nil {
+		migration.log().WithError(err).Warn("unable to record commit")
+	}
+
+	return nil
+}
+
+// freezeProcess stops p so that it and its restored copy never both answer
+// traffic. Post-copy dumps have already stopped it.
+func freezeProcess(p Process) {
+	if err := syscall.Kill(int(p.Pid), syscall.SIGSTOP); err != nil && err != syscall.ESRCH {
+		logger.WithError(err).WithField("pid", p.Pid).Error("unable to freeze process")
+	}
+}
+
+// requestCommit tells destination that its restored copy from migration id is
+// now the authoritative one. Only a 409 is a refusal; a destination that
+// doesn't know the migration may have committed it and then restarted.
+func requestCommit(destination, id string) error {
+	res, err := peerClient.Post(peerURL(destination, "/CommitMigration?migration="+url.QueryEscape(id)),
+		"application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	err = responseError(res)
+	if res.StatusCode == http.StatusConflict {
+		return commitRefusedError{err}
+	}
+
+	return err
+}
+
+// strandMigration gives up on a migration of p whose commit went unanswered.
+// The destination may already be running its copy, so it is not aborted, and
+// the original stays frozen until an operator resumes or kills one of them.
+func strandMigration(migration *Migration, p Process, destination string, cause error) {
+	migration.fail(cause)
+
+	MigrationClocks.Delete(p.Pid)
+	saveState()
+
+	notes := "commit outcome unknown; original left frozen here and destination " +
+		destination + " left as is"
+	migration.setRollback(notes)
+	migration.log().WithFields(logrus.Fields{"rollback": notes, "frozen_pid": p.Pid}).
+		Error("migration stranded")
+}
+
+// commitIncomingMigration finishes migration id on the destination:
+// outstanding shadowed frames are delivered and the bookkeeping and images
+// used to restore the process are discarded. The restored process stays
+// registered, so it can be migrated again. Committing a migration again
+// succeeds; errNoMigration means we have no record of it at all.
+func commitIncomingMigration(id string) error {
+	log := incomingLog(id)
+
+	if _, ok := CommittedMigrations.Load(id); ok {
+		log.Info("migration already committed")
+		return nil
+	}
+
+	incoming, err := loadIncoming(id)
+	if err != nil {
+		return err
+	}
+
+	incoming.m.Lock()
+	restoredPid := incoming.restoredPid
+	incoming.m.Unlock()
+
+	if restoredPid == 0 {
+		return fmt.Errorf("commitIncomingMigration(): %s was never restored", id)
+	}
+
+	if ibuffer, ok := ShadowBuffers.Load(id); ok {
+		if buffer, ok := ibuffer.(*shadowBuffer); ok {
+			buffer.flush()
+			buffer.close()
+		}
+		ShadowBuffers.Delete(id)
+	}
+
+	CommittedMigrations.Store(id, restoredPid)
+	IncomingMigrations.Delete(id)
+
+	// the process is ours now, so leftover images are no reason to refuse
+	if err := removeCheckpoints(id); err != nil {
+		log.WithError(err).Warn("unable to remove images")
+	}
+
+	return nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/checkpoint-restore/go-criu/rpc"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultBridgeName = "handoff-bridge"
+	MaxInterfaceName  = 15 // IFNAMSIZ less the terminating NUL
+)
+
+// Config is everything a node can be configured with. It is read from a YAML
+// or TOML file, and any flags given to serve override the file.
+type Config struct {
+	Iface         string        `yaml:"iface" toml:"iface"`                   // public-facing network interface
+	Port          int           `yaml:"port" toml:"port"`                     // port to listen on
+	NetworkCIDR   string        `yaml:"network_cidr" toml:"network_cidr"`     // CIDR block(s) of the virtual net
+	Bridge        string        `yaml:"bridge" toml:"bridge"`                 // bridge every namespace joins
+	ImageDir      string        `yaml:"image_dir" toml:"image_dir"`           // where checkpoints are written and received
+	StateFile     string        `yaml:"state_file" toml:"state_file"`         // where node state is journaled; empty to keep none
+	InventoryFile string        `yaml:"inventory_file" toml:"inventory_file"` // where changes to the host are listed, for cleanup
+	Peers         []PeerConfig  `yaml:"peers" toml:"peers"`
+	IPAM          IPAMConfig    `yaml:"ipam" toml:"ipam"`
+	Overlay       OverlayConfig `yaml:"overlay" toml:"overlay"`
+	CRIU          CRIUConfig    `yaml:"criu" toml:"criu"`
+	TLS           TLSConfig     `yaml:"tls" toml:"tls"`
+	Auth          AuthConfig    `yaml:"auth" toml:"auth"`
+	Log           LogConfig     `yaml:"log" toml:"log"`
+
+	unknownKeys []string // keys in a TOML file that match no setting
+}
+
+// PeerConfig names another node, so migrations can be sent to it by name
+type PeerConfig struct {
+	Name    string `yaml:"name" toml:"name"`
+	Address string `yaml:"address" toml:"address"` // host:port the node serves on
+	VTEP    string `yaml:"vtep" toml:"vtep"`       // the node's overlay endpoint; defaults to Address's host
+}
+
+// IPAMConfig shapes how addresses are handed out in the virtual network
+type IPAMConfig struct {
+	Exclude      []string            `yaml:"exclude" toml:"exclude"`             // addresses, first-last ranges, or CIDR blocks
+	AllocateFrom []string            `yaml:"allocate_from" toml:"allocate_from"` // one range per family; defaults to the whole block
+	Reservations []ReservationConfig `yaml:"reservations" toml:"reservations"`
+}
+
+// ReservationConfig keeps Addr for Owner, which is "pid:<pid>" for a migrated
+// process (its PID on the source) or the command for execInNetNS. A
+// dual-stack owner may reserve one address of each family.
+type ReservationConfig struct {
+	Owner string `yaml:"owner" toml:"owner"`
+	Addr  string `yaml:"addr" toml:"addr"`
+}
+
+// OverlayConfig joins the node's bridge to a VXLAN segment shared with its
+// peers. Every node on the segment needs its own bridge address (the host part
+// of network_cidr) and its own ipam.allocate_from range.
+type OverlayConfig struct {
+	VNI    int    `yaml:"vni" toml:"vni"`       // VXLAN network identifier; 0 leaves the overlay off
+	Port   int    `yaml:"port" toml:"port"`     // UDP port VXLAN runs over
+	Device string `yaml:"device" toml:"device"` // name of the VXLAN interface
+	Local  string `yaml:"local" toml:"local"`   // this node's endpoint; defaults to an address of iface
+}
+
+// CRIUConfig holds the CRIU options used for every dump and restore
+type CRIUConfig struct {
+	ShellJob       bool   `yaml:"shell_job" toml:"shell_job"`
+	TCPEstablished bool   `yaml:"tcp_established" toml:"tcp_established"`
+	ExtUnixSockets bool   `yaml:"ext_unix_sockets" toml:"ext_unix_sockets"`
+	FileLocks      bool   `yaml:"file_locks" toml:"file_locks"`
+	LogLevel       int32  `yaml:"log_level" toml:"log_level"` // 0 (none) through 4 (debug)
+	LogFile        string `yaml:"log_file" toml:"log_file"`   // relative to each image directory
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert" toml:"cert"` // this node's certificate
+	Key  string `yaml:"key" toml:"key"`   // private key for Cert
+	CA   string `yaml:"ca" toml:"ca"`     // CA that signs every node's certificate
+}
+
+type AuthConfig struct {
+	OperatorToken string `yaml:"operator_token" toml:"operator_token"`
+	PeerToken     string `yaml:"peer_token" toml:"peer_token"`
+	MetricsToken  string `yaml:"metrics_token" toml:"metrics_token"` // read-only, for scrapers
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+	File   string `yaml:"file" toml:"file"` // empty for stderr
+}
+
+var (
+	// the configuration serve started with
+	nodeConfig Config = defaultConfig()
+)
+
+func defaultConfig() Config {
+	return Config{
+		Port:          8080,
+		NetworkCIDR:   "172.31.0.0/24",
+		Bridge:        DefaultBridgeName,
+		ImageDir:      ".",
+		StateFile:     "handoff-state.json",
+		InventoryFile: "handoff-inventory.json",
+		Overlay:       OverlayConfig{Port: DefaultVXLANPort, Device: DefaultVXLANDevice},
+		CRIU:          CRIUConfig{ShellJob: true},
+		Log:           LogConfig{Level: "info", Format: LogFormatText},
+	}
+}
+
+// serveFlags defines serve's flags, each of which overrides a setting in
+// config when it is given. The returned string is the -config path.
+func serveFlags(config *Config) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	path := flags.String("config", "", "YAML or TOML file to read settings from")
+	flags.StringVar(&config.Iface, "iface", config.Iface, "public-facing network interface")
+	flags.IntVar(&config.Port, "port", config.Port, "port to listen on")
+	flags.StringVar(&config.NetworkCIDR, "network-cidr", config.NetworkCIDR,
+		"CIDR block of virtual net, or an IPv4 and an IPv6 block separated by a comma")
+	flags.StringVar(&config.Bridge, "bridge", config.Bridge, "bridge every namespace joins")
+	flags.StringVar(&config.ImageDir, "image-dir", config.ImageDir,
+		"where checkpoints are written and received")
+	flags.StringVar(&config.StateFile, "state-file", config.StateFile,
+		"where node state is journaled (empty to keep none)")
+	flags.StringVar(&config.InventoryFile, "inventory-file", config.InventoryFile,
+		"where changes to the host are listed for handoff cleanup (empty to keep none)")
+	flags.IntVar(&config.Overlay.VNI, "overlay-vni", config.Overlay.VNI,
+		"VXLAN network identifier shared with peers (enables the overlay)")
+	flags.StringVar(&config.Overlay.Local, "overlay-local", config.Overlay.Local,
+		"this node's overlay endpoint (defaults to an address of -iface)")
+	flags.StringVar(&config.TLS.Cert, "tls-cert", config.TLS.Cert,
+		"this node's certificate (enables mutual TLS)")
+	flags.StringVar(&config.TLS.Key, "tls-key", config.TLS.Key, "private key for -tls-cert")
+	flags.StringVar(&config.TLS.CA, "tls-ca", config.TLS.CA,
+		"CA that signs every node's certificate")
+	flags.StringVar(&config.Auth.OperatorToken, "operator-token", config.Auth.OperatorToken,
+		"bearer token for register/migrate requests (enables auth)")
+	flags.StringVar(&config.Auth.PeerToken, "peer-token", config.Auth.PeerToken,
+		"bearer token shared by every node in the cluster")
+	flags.StringVar(&config.Auth.MetricsToken, "metrics-token", config.Auth.MetricsToken,
+		"bearer token that can only read /metrics")
+	flags.StringVar(&config.Log.Level, "log-level", config.Log.Level,
+		"least severe level to log (debug, info, warn, error)")
+	flags.StringVar(&config.Log.Format, "log-format", config.Log.Format, "logfmt or json")
+	flags.StringVar(&config.Log.File, "log-file", config.Log.File,
+		"file to log to instead of stderr")
+
+	return flags, path
+}
+
+// parseServeArgs builds serve's configuration: the defaults, then the -config
+// file if there is one, then any flags
+func parseServeArgs(args []string) (Config, error) {
+	config := defaultConfig()
+
+	// the first pass only finds the file; the second lets flags override it
+	flags, path := serveFlags(&Config{})
+	flags.Parse(args)
+
+	if *path != "" {
+		if err := loadConfig(*path, &config); err != nil {
+			return config, err
+		}
+	}
+
+	flags, _ = serveFlags(&config)
+	flags.Parse(args)
+
+	return config, nil
+}
+
+// loadConfig reads path over config. Files ending in .toml are TOML and
+// anything else is YAML.
+func loadConfig(path string, config *Config) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// the TOML decoder can't be made strict, so what it skipped is left for
+	// validate to report alongside everything else
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		meta, err := toml.Decode(string(contents), config)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		for _, key := range meta.Undecoded() {
+			config.unknownKeys = append(config.unknownKeys, key.String())
+		}
+		return nil
+	}
+
+	if err := yaml.UnmarshalStrict(contents, config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// validate reports every problem with the configuration rather than just the
+// first, so they can all be fixed at once
+func (c Config) validate() []error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	for _, key := range c.unknownKeys {
+		problem("unknown setting %q", key)
+	}
+
+	if c.Iface == "" {
+		problem("no iface provided")
+	} else if _, err := net.InterfaceByName(c.Iface); err != nil {
+		problem("iface %q: %v", c.Iface, err)
+	}
+
+	if 0 > c.Port || 65535 < c.Port {
+		problem("invalid port %d", c.Port)
+	}
+
+	// ipam.go
+	_, networkErr := splitNetworks(c.NetworkCIDR)
+	if networkErr != nil {
+		problem("network_cidr: %v", networkErr)
+	}
+
+	if c.Bridge == "" || len(c.Bridge) > MaxInterfaceName {
+		problem("bridge name must be 1 to %d characters", MaxInterfaceName)
+	}
+
+	if c.ImageDir == "" {
+		problem("no image_dir provided")
+	} else if info, err := os.Stat(c.ImageDir); err != nil && !os.IsNotExist(err) {
+		problem("image_dir: %v", err)
+	} else if err == nil && !info.IsDir() {
+		problem("image_dir %s is not a directory", c.ImageDir)
+	}
+
+	if c.StateFile != "" {
+		if info, err := os.Stat(filepath.Dir(c.StateFile)); err != nil {
+			problem("state_file: %v", err)
+		} else if !info.IsDir() {
+			problem("state_file: %s is not a directory", filepath.Dir(c.StateFile))
+		}
+	}
+
+	if c.InventoryFile != "" {
+		if info, err := os.Stat(filepath.Dir(c.InventoryFile)); err != nil {
+			problem("inventory_file: %v", err)
+		} else if !info.IsDir() {
+			problem("inventory_file: %s is not a directory", filepath.Dir(c.InventoryFile))
+		}
+	}
+
+	names := map[string]bool{}
+	for i, peer := range c.Peers {
+		if peer.Name == "" {
+			problem("peer %d has no name", i+1)
+		} else if names[peer.Name] {
+			problem("peer %q is listed twice", peer.Name)
+		}
+		names[peer.Name] = true
+
+		if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+			problem("peer %q: %v", peer.Name, err)
+		}
+
+		if peer.VTEP != "" && net.ParseIP(peer.VTEP) == nil {
+			problem("peer %q: vtep %q is not an address", peer.Name, peer.VTEP)
+		}
+	}
+
+	if networkErr == nil {
+		if _, err := newIPAM(c.NetworkCIDR, c.IPAM.Exclude, c.IPAM.AllocateFrom, c.IPAM.Reservations); err != nil {
+			problem("ipam: %v", err)
+		}
+	}
+
+	if c.Overlay.VNI < 0 || c.Overlay.VNI > MaxVNI {
+		problem("overlay vni must be 0 through %d", MaxVNI)
+	}
+	if c.Overlay.useOverlay() {
+		if 0 >= c.Overlay.Port || 65535 < c.Overlay.Port {
+			problem("invalid overlay port %d", c.Overlay.Port)
+		}
+		if c.Overlay.Device == "" || len(c.Overlay.Device) > MaxInterfaceName {
+			problem("overlay device name must be 1 to %d characters", MaxInterfaceName)
+		}
+		if c.Overlay.Local != "" && net.ParseIP(c.Overlay.Local) == nil {
+			problem("overlay local %q is not an address", c.Overlay.Local)
+		}
+	}
+
+	if c.CRIU.LogLevel < 0 || c.CRIU.LogLevel > 4 {
+		problem("criu log_level must be 0 through 4")
+	}
+
+	useTLS := c.TLS.Cert != "" || c.TLS.Key != "" || c.TLS.CA != ""
+	if useTLS && (c.TLS.Cert == "" || c.TLS.Key == "" || c.TLS.CA == "") {
+		problem("tls cert, key and ca must be used together")
+	}
+	for _, file := range []string{c.TLS.Cert, c.TLS.Key, c.TLS.CA} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problem("tls: %v", err)
+		}
+	}
+
+	useAuth := c.Auth.OperatorToken != "" || c.Auth.PeerToken != ""
+	if useAuth && (c.Auth.OperatorToken == "" || c.Auth.PeerToken == "") {
+		problem("operator and peer tokens must be used together")
+	}
+	if useAuth && c.Auth.OperatorToken == c.Auth.PeerToken {
+		problem("operator and peer tokens must differ")
+	}
+	if c.Auth.MetricsToken != "" && !useAuth {
+		problem("metrics token needs operator and peer tokens")
+	}
+	if c.Auth.MetricsToken != "" &&
+		(c.Auth.MetricsToken == c.Auth.OperatorToken || c.Auth.MetricsToken == c.Auth.PeerToken) {
+		problem("metrics token must differ from the operator and peer tokens")
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		problem("log level: %v", err)
+	}
+	if c.Log.Format != LogFormatText && c.Log.Format != LogFormatJSON {
+		problem("log format must be %s or %s", LogFormatText, LogFormatJSON)
+	}
+
+	return problems
+}
+
+// useTLS reports whether the node serves and contacts peers over mutual TLS
+func (c Config) useTLS() bool {
+	return c.TLS.Cert != ""
+}
+
+// useAuth reports whether the node requires bearer tokens
+func (c Config) useAuth() bool {
+	return c.Auth.OperatorToken != ""
+}
+
+// useOverlay reports whether the bridge joins a VXLAN segment
+func (c OverlayConfig) useOverlay() bool {
+	return c.VNI != 0
+}
+
+// resolvePeer returns the address of the peer called name, or name itself if
+// there is no such peer
+func (c Config) resolvePeer(name string) string {
+	for _, peer := range c.Peers {
+		if peer.Name == name {
+			return peer.Address
+		}
+	}
+
+	return name
+}
+
+// apply sets the configured options on options
+func (c CRIUConfig) apply(options *rpc.CriuOpts) {
+	shellJob := c.ShellJob
+	tcpEstablished := c.TCPEstablished
+	extUnixSockets := c.ExtUnixSockets
+	fileLocks := c.FileLocks
+
+	options.ShellJob = &shellJob
+	options.TcpEstablished = &tcpEstablished
+	options.ExtUnixSk = &extUnixSockets
+	options.FileLocks = &fileLocks
+
+	if c.LogLevel > 0 {
+		logLevel := c.LogLevel
+		options.LogLevel = &logLevel
+	}
+
+	if c.LogFile != "" {
+		logFile := c.LogFile
+		options.LogFile = &logFile
+	}
+}
+
+// joinErrors flattens problems into one error under heading, one problem per
+// line
+func joinErrors(heading string, problems []error) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	lines := make([]string, len(problems))
+	for i, problem := range problems {
+		lines[i] = "  " + problem.Error()
+	}
+
+	return errors.New(heading + ":\n" + strings.Join(lines, "\n"))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventState    = "state"    // a migration changed state
+	EventUpload   = "upload"   // more of a checkpoint reached the destination
+	EventFrame    = "frame"    // a frame was shadowed to the destination
+	EventDowntime = "downtime" // a migration committed after this much downtime
+
+	EventQueueLength     = 256              // events buffered per slow subscriber
+	EventHeartbeatPeriod = 15 * time.Second // keeps idle streams from timing out
+)
+
+// MigrationEvent is one entry in the /Events stream. Which fields are set
+// depends on Type.
+type MigrationEvent struct {
+	Type        string
+	MigrationID string
+	Pid         int32
+	Time        time.Time
+	State       MigrationState  `json:",omitempty"`
+	Error       string          `json:",omitempty"`
+	Bytes       int64           `json:",omitempty"` // checkpoint bytes uploaded so far
+	Clock       *MigrationClock `json:",omitempty"` // clock the frame was sent with
+	Downtime    time.Duration   `json:",omitempty"`
+}
+
+// eventBroker fans events out to every /Events subscriber
+type eventBroker struct {
+	subscribers map[chan MigrationEvent]bool
+	m           sync.Mutex
+}
+
+var (
+	Events *eventBroker = &eventBroker{subscribers: map[chan MigrationEvent]bool{}}
+)
+
+// publish never blocks; a subscriber that falls too far behind misses events
+func (b *eventBroker) publish(event MigrationEvent) {
+	event.Time = time.Now()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+func (b *eventBroker) subscribe() chan MigrationEvent {
+	subscriber := make(chan MigrationEvent, EventQueueLength)
+
+	b.m.Lock()
+	b.subscribers[subscriber] = true
+	b.m.Unlock()
+
+	return subscriber
+}
+
+func (b *eventBroker) unsubscribe(subscriber chan MigrationEvent) {
+	b.m.Lock()
+	delete(b.subscribers, subscriber)
+	b.m.Unlock()
+}
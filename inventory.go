@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/shirou/gopsutil/process"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	ResourceLink    = "link"            // a link we created: the bridge, the VXLAN device, or a veth pair
+	ResourceAddr    = "addr"            // an address we added to a link we didn't create
+	ResourceFDB     = "fdb"             // a flood entry we added to a VXLAN device we didn't create
+	ResourceRule    = "iptables-rule"   // a rule we appended
+	ResourcePolicy  = "iptables-policy" // a chain policy we changed, and what it was before
+	ResourceMount   = "mount"           // a namespace we bind mounted
+	ResourceProcess = "process"         // a process we started in a namespace of its own
+	ResourceSysctl  = "sysctl"          // a sysctl we changed, and what it was before
+)
+
+const (
+	IPv6ForwardingSysctl = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+// Resource is one change the node made to the host. A namespace has no name
+// to remove it by; it is freed once its last process exits and its veth pair
+// and bind mounts are gone, so that is what the inventory tracks.
+type Resource struct {
+	Kind     string
+	Name     string   `json:",omitempty"` // the link, the mount's path, or the sysctl's
+	Addr     string   `json:",omitempty"` // the address, or the VTEP flooded to
+	Protocol string   `json:",omitempty"` // "ipv4" or "ipv6"
+	Table    string   `json:",omitempty"`
+	Chain    string   `json:",omitempty"`
+	Rule     []string `json:",omitempty"`
+	Policy   string   `json:",omitempty"` // the policy to restore
+	Pid      int32    `json:",omitempty"`
+	Command  string   `json:",omitempty"` // what Pid runs, so a reused PID is left alone
+	Value    string   `json:",omitempty"` // the sysctl's value to restore
+}
+
+// Inventory lists everything the node has changed on the host, in the order
+// it was changed, so that it can all be reverted. It is kept on disk, so a
+// node that crashed can still be cleaned up.
+type Inventory struct {
+	path      string // empty to keep the inventory in memory only
+	resources []Resource
+	m         sync.Mutex
+}
+
+var (
+	inventory *Inventory = &Inventory{}
+)
+
+// loadInventory reads what an earlier run left behind at path, and keeps
+// recording there. A missing file is an empty inventory.
+func loadInventory(path string) (*Inventory, error) {
+	inv := &Inventory{path: path}
+	if path == "" {
+		return inv, nil
+	}
+
+	jsonBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(jsonBytes, &inv.resources); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return inv, nil
+}
+
+// record adds r to the inventory
+func (inv *Inventory) record(r Resource) {
+	inv.m.Lock()
+	defer inv.m.Unlock()
+
+	inv.resources = append(inv.resources, r)
+	inv.save()
+}
+
+// forget drops the resources of kind called name, once something else has
+// reverted them
+func (inv *Inventory) forget(kind, name string) {
+	inv.m.Lock()
+	defer inv.m.Unlock()
+
+	kept := inv.resources[:0]
+	for _, r := range inv.resources {
+		if r.Kind != kind || r.Name != name {
+			kept = append(kept, r)
+		}
+	}
+	inv.resources = kept
+	inv.save()
+}
+
+// save writes the inventory out. inv.m must be held.
+func (inv *Inventory) save() {
+	if inv.path == "" {
+		return
+	}
+
+	// state.go
+	jsonBytes, err := json.Marshal(inv.resources)
+	if err == nil {
+		err = writeFileAtomic(inv.path, jsonBytes)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("path", inv.path).Error("unable to save inventory")
+	}
+}
+
+// teardown reverts every resource that keep doesn't pick, newest first.
+// Resources that are kept, or can't be reverted, stay in the inventory. A nil
+// keep reverts everything.
+func (inv *Inventory) teardown(keep func(Resource) bool) error {
+	inv.m.Lock()
+	defer inv.m.Unlock()
+
+	var left []Resource
+	var problems []error
+	for i := len(inv.resources) - 1; i >= 0; i-- {
+		r := inv.resources[i]
+		log := logger.WithFields(logrus.Fields{"kind": r.Kind, "name": r.Name, "addr": r.Addr})
+
+		if keep != nil && keep(r) {
+			left = append([]Resource{r}, left...)
+			log.Debug("kept")
+			continue
+		}
+
+		if err := revert(r); err != nil {
+			log.WithError(err).Error("unable to revert")
+			left = append([]Resource{r}, left...)
+			problems = append(problems, fmt.Errorf("%s %s: %v", r.Kind, describe(r), err))
+			continue
+		}
+		log.Debug("reverted")
+	}
+
+	inv.resources = left
+	inv.save()
+
+	if inv.path != "" && len(left) == 0 {
+		if err := os.Remove(inv.path); err != nil && !os.IsNotExist(err) {
+			problems = append(problems, err)
+		}
+	}
+
+	return joinErrors("unable to revert", problems)
+}
+
+// shutdown reverts what the node changed on the host as it stops, except for
+// namespaces: the processes in them outlive the node, which picks them up
+// again when it restarts. While any namespace is left, so is the bridge and
+// overlay it is attached to. A namespace is removed when its process
+// migrates away or an incoming migration is aborted, or by handoff cleanup.
+func (inv *Inventory) shutdown() error {
+	inv.m.Lock()
+	attached := false
+	for _, r := range inv.resources {
+		attached = attached || inNamespace(r)
+	}
+	inv.m.Unlock()
+
+	return inv.teardown(func(r Resource) bool {
+		if inNamespace(r) {
+			return true
+		}
+
+		switch r.Kind {
+		case ResourceLink, ResourceAddr, ResourceFDB:
+			return attached
+		}
+		return false
+	})
+}
+
+// inNamespace reports whether r belongs to one process's namespace rather
+// than to the host
+func inNamespace(r Resource) bool {
+	switch r.Kind {
+	case ResourceMount, ResourceProcess:
+		return true
+	case ResourceLink:
+		// the bridge-side end of a namespace's veth pair (virtual_network.go)
+		return strings.HasPrefix(r.Name, "brveth")
+	}
+
+	return false
+}
+
+// revert undoes r. Something that is already gone counts as reverted.
+func revert(r Resource) error {
+	switch r.Kind {
+	case ResourceLink:
+		link, err := netlink.LinkByName(r.Name)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return netlink.LinkDel(link)
+
+	case ResourceAddr:
+		link, err := netlink.LinkByName(r.Name)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		addr, err := netlink.ParseAddr(r.Addr)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrDel(link, addr); err != nil && err != syscall.EADDRNOTAVAIL {
+			return err
+		}
+		return nil
+
+	case ResourceFDB:
+		link, err := netlink.LinkByName(r.Name)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			IP:           net.ParseIP(r.Addr),
+			HardwareAddr: make(net.HardwareAddr, 6),
+		}
+		if err := netlink.NeighDel(entry); err != nil && err != syscall.ENOENT {
+			return err
+		}
+		return nil
+
+	case ResourceRule:
+		table, err := iptables.NewWithProtocol(parseProtocol(r.Protocol))
+		if err != nil {
+			return err
+		}
+
+		exists, err := table.Exists(r.Table, r.Chain, r.Rule...)
+		if err != nil || !exists {
+			return err
+		}
+		return table.Delete(r.Table, r.Chain, r.Rule...)
+
+	case ResourcePolicy:
+		table, err := iptables.NewWithProtocol(parseProtocol(r.Protocol))
+		if err != nil {
+			return err
+		}
+		return table.ChangePolicy(r.Table, r.Chain, r.Policy)
+
+	case ResourceMount:
+		mounted, err := mount.Mounted(r.Name)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			if err := mount.Unmount(r.Name); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(r.Name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case ResourceProcess:
+		p, err := process.NewProcess(r.Pid)
+		if err != nil {
+			// it has already exited
+			return nil
+		}
+		// the kernel truncates the names it reports
+		if name, err := p.Name(); err != nil || name == "" || !strings.HasPrefix(r.Command, name) {
+			return nil
+		}
+
+		if err := syscall.Kill(int(r.Pid), syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		return nil
+
+	case ResourceSysctl:
+		if err := ioutil.WriteFile(r.Name, []byte(r.Value+"\n"), 0644); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown kind of resource %q", r.Kind)
+}
+
+func describe(r Resource) string {
+	switch r.Kind {
+	case ResourceRule, ResourcePolicy:
+		return fmt.Sprintf("%s %s/%s", r.Protocol, r.Table, r.Chain)
+	case ResourceProcess:
+		return fmt.Sprintf("%s (pid %d)", r.Command, r.Pid)
+	case ResourceAddr, ResourceFDB:
+		return r.Name + " " + r.Addr
+	case ResourceSysctl:
+		return fmt.Sprintf("%s (was %s)", r.Name, r.Value)
+	}
+
+	return r.Name
+}
+
+// protocolName and parseProtocol carry an iptables.Protocol through JSON
+func protocolName(protocol iptables.Protocol) string {
+	if protocol == iptables.ProtocolIPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+func parseProtocol(name string) iptables.Protocol {
+	if name == "ipv6" {
+		return iptables.ProtocolIPv6
+	}
+	return iptables.ProtocolIPv4
+}
+
+// chainPolicy reads the policy of a built-in chain
+func chainPolicy(table *iptables.IPTables, tableName, chain string) (string, error) {
+	rules, err := table.List(tableName, chain)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) == 3 && fields[0] == "-P" && fields[1] == chain {
+			return fields[2], nil
+		}
+	}
+
+	return "", fmt.Errorf("%s/%s has no policy", tableName, chain)
+}
+
+// cleanupCommand reverts what a node that is no longer running left behind
+func cleanupCommand(args []string) {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	configPtr := flags.String("config", "", "the node's YAML or TOML config file")
+	inventoryPtr := flags.String("inventory-file", "",
+		"inventory to revert (defaults to the config's, or "+defaultConfig().InventoryFile+")")
+	flags.Parse(args)
+
+	config := defaultConfig()
+	if *configPtr != "" {
+		// config.go
+		exitOnError(loadConfig(*configPtr, &config))
+	}
+	if *inventoryPtr != "" {
+		config.InventoryFile = *inventoryPtr
+	}
+
+	if config.InventoryFile == "" {
+		exitOnError(errors.New("the node keeps no inventory"))
+	}
+
+	if os.Geteuid() != 0 {
+		exitOnError(errors.New("must be invoked as root"))
+	}
+
+	inv, err := loadInventory(config.InventoryFile)
+	exitOnError(err)
+
+	count := len(inv.resources)
+	exitOnError(inv.teardown(nil))
+
+	fmt.Printf("reverted %d changes\n", count)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInventoryShutdownKeepsNamespaces(t *testing.T) {
+	// sysctls are the only host-level kind that reverts without root
+	sysctl := func(name string) Resource {
+		return Resource{Kind: ResourceSysctl, Name: "/nonexistent/" + name, Value: "0"}
+	}
+
+	tests := []struct {
+		name      string
+		resources []Resource
+		want      []Resource
+	}{
+		{
+			name: "namespaces keep the network up",
+			resources: []Resource{
+				{Kind: ResourceLink, Name: "handoff0"},
+				{Kind: ResourceAddr, Name: "handoff0", Addr: "10.0.0.254/24"},
+				sysctl("forwarding"),
+				{Kind: ResourceLink, Name: "brveth1"},
+				{Kind: ResourceMount, Name: "/var/run/netns/handoff-1"},
+				{Kind: ResourceProcess, Pid: 42, Command: "nc"},
+			},
+			want: []Resource{
+				{Kind: ResourceLink, Name: "handoff0"},
+				{Kind: ResourceAddr, Name: "handoff0", Addr: "10.0.0.254/24"},
+				{Kind: ResourceLink, Name: "brveth1"},
+				{Kind: ResourceMount, Name: "/var/run/netns/handoff-1"},
+				{Kind: ResourceProcess, Pid: 42, Command: "nc"},
+			},
+		},
+		{
+			name:      "only host-level changes",
+			resources: []Resource{sysctl("a"), sysctl("b")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inv := &Inventory{resources: test.resources}
+			if err := inv.shutdown(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(inv.resources, test.want) {
+				t.Errorf("left %+v, want %+v", inv.resources, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lease records who holds an address in the virtual network
+type Lease struct {
+	Addr  string
+	Owner string // what the address was allocated for
+	Pid   int32  // process using the address, once there is one
+	Link  string // bridge-side link of the namespace holding the address
+	Since time.Time
+}
+
+// PoolStatus is what the API reports about the virtual network's addresses
+type PoolStatus struct {
+	Networks     []NetworkStatus
+	Free         uint64            // namespaces allocate could still address
+	Excluded     []string          // ranges never handed out
+	Reservations map[string]string // maps a reserved address to its owner
+	Leases       []Lease
+}
+
+// NetworkStatus reports on one address family's block
+type NetworkStatus struct {
+	Network string
+	Size    uint64 // addresses this node allocates from, before exclusions
+	Free    uint64 // addresses allocate could still hand out
+}
+
+// addrRange is an inclusive range of addresses
+type addrRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// subnet is the pool's block for one address family
+type subnet struct {
+	network *net.IPNet
+	hosts   addrRange // every assignable address
+	first   net.IP    // first address this node allocates
+	last    net.IP    // last address this node allocates
+	next    net.IP    // where the next search starts
+}
+
+// IPAM hands out addresses in the virtual network, one from each of its
+// subnets. Addresses are searched for on demand rather than listed up front,
+// so an IPv6 /64 costs no more than an IPv4 /24, and the search continues
+// from the last allocation so released addresses are reused as late as
+// possible.
+type IPAM struct {
+	subnets  []*subnet // at most one per address family
+	excluded []addrRange
+	reserved map[string]string // address -> owner
+	leases   map[string]*Lease // address -> lease
+	m        sync.Mutex
+}
+
+var (
+	// the virtual network's addresses; set up by verifyBridgePresence
+	addressPool *IPAM
+)
+
+// splitNetworks reads a network_cidr setting: a CIDR block, or an IPv4 and an
+// IPv6 block separated by a comma
+func splitNetworks(spec string) ([]string, error) {
+	var cidrs []string
+	families := map[bool]bool{}
+	for _, cidr := range strings.Split(spec, ",") {
+		cidr = strings.TrimSpace(cidr)
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		v4 := ip.To4() != nil
+		if families[v4] {
+			return nil, fmt.Errorf("%s: only one block per address family", spec)
+		}
+		families[v4] = true
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
+
+// newIPAM manages the hosts of the blocks in spec, never handing out
+// anything in exclude. New addresses only come from allocateFrom, when it
+// narrows a block, though any host may still be claimed. Each reserved
+// address is only handed out to its owner.
+func newIPAM(spec string, exclude, allocateFrom []string, reservations []ReservationConfig) (*IPAM, error) {
+	cidrs, err := splitNetworks(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &IPAM{
+		reserved: map[string]string{},
+		leases:   map[string]*Lease{},
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		base := normalizeIP(network.IP)
+		top := make(net.IP, len(base))
+		for i := range base {
+			top[i] = base[i] | ^network.Mask[i]
+		}
+
+		// the network address is never assignable, nor is IPv4's broadcast
+		// address. IPv6 has no broadcast.
+		first, last := dup(base), top
+		inc(first)
+		if len(base) == net.IPv4len {
+			dec(last)
+		}
+		if bytes.Compare(first, last) > 0 {
+			return nil, fmt.Errorf("%s has no assignable addresses", cidr)
+		}
+
+		pool.subnets = append(pool.subnets, &subnet{
+			network: network,
+			hosts:   addrRange{first: first, last: last},
+			first:   first,
+			last:    last,
+			next:    dup(first),
+		})
+	}
+
+	// nodes sharing a network each allocate from their own part of it
+	narrowed := map[*subnet]bool{}
+	for _, from := range allocateFrom {
+		r, err := parseRange(from)
+		if err != nil {
+			return nil, err
+		}
+
+		s := pool.subnetOf(r.first)
+		if s == nil || !s.network.Contains(r.last) {
+			return nil, fmt.Errorf("allocation range %s is outside %s", from, spec)
+		}
+		if narrowed[s] {
+			return nil, fmt.Errorf("two allocation ranges in %s", s.network)
+		}
+		narrowed[s] = true
+
+		if bytes.Compare(r.first, s.hosts.first) > 0 {
+			s.first = r.first
+		}
+		if bytes.Compare(r.last, s.hosts.last) < 0 {
+			s.last = r.last
+		}
+		if bytes.Compare(s.first, s.last) > 0 {
+			return nil, fmt.Errorf("allocation range %s has no assignable addresses", from)
+		}
+		s.next = dup(s.first)
+	}
+
+	for _, excluded := range exclude {
+		r, err := parseRange(excluded)
+		if err != nil {
+			return nil, err
+		}
+		if s := pool.subnetOf(r.first); s == nil || !s.network.Contains(r.last) {
+			return nil, fmt.Errorf("excluded range %s is outside %s", excluded, spec)
+		}
+		pool.excluded = append(pool.excluded, r)
+	}
+
+	// an owner gets at most one address from each subnet
+	type ownerSubnet struct {
+		owner  string
+		subnet *subnet
+	}
+	reservedIn := map[ownerSubnet]string{}
+	for _, reservation := range reservations {
+		ip := net.ParseIP(reservation.Addr)
+		if ip == nil || !pool.assignable(normalizeIP(ip)) {
+			return nil, fmt.Errorf("reservation for %s: %s is not assignable",
+				reservation.Owner, reservation.Addr)
+		}
+
+		addr := normalizeIP(ip).String()
+		if other, ok := pool.reserved[addr]; ok {
+			return nil, fmt.Errorf("%s is reserved for both %s and %s", addr, other, reservation.Owner)
+		}
+
+		key := ownerSubnet{reservation.Owner, pool.subnetOf(normalizeIP(ip))}
+		if other, ok := reservedIn[key]; ok {
+			return nil, fmt.Errorf("%s has two reservations in %s: %s and %s",
+				reservation.Owner, key.subnet.network, other, addr)
+		}
+		reservedIn[key] = addr
+		pool.reserved[addr] = reservation.Owner
+	}
+
+	return pool, nil
+}
+
+// allocate leases owner an address from each subnet for the namespace behind
+// link. Requested addresses are claimed as they are, and an owner with a
+// reservation always gets its reserved address.
+func (p *IPAM) allocate(owner, link string, requested []string) ([]string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	wanted := map[*subnet]string{}
+	for _, addr := range requested {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an address", addr)
+		}
+
+		s := p.subnetOf(normalizeIP(ip))
+		if s == nil {
+			return nil, fmt.Errorf("%s is outside the virtual network", addr)
+		}
+		if _, ok := wanted[s]; ok {
+			return nil, fmt.Errorf("two addresses requested in %s", s.network)
+		}
+		wanted[s] = normalizeIP(ip).String()
+	}
+
+	previous := map[string]*Lease{}
+	var addrs []string
+	for _, s := range p.subnets {
+		addr, ok := wanted[s]
+		var err error
+		if ok {
+			err = p.checkClaim(addr, owner)
+		} else {
+			addr, err = p.allocateFrom(s, owner)
+		}
+
+		if err != nil {
+			// it's all or nothing
+			for _, addr := range addrs {
+				if lease, ok := previous[addr]; ok {
+					p.leases[addr] = lease
+				} else {
+					delete(p.leases, addr)
+				}
+			}
+			return nil, err
+		}
+
+		if lease, ok := p.leases[addr]; ok {
+			previous[addr] = lease
+		}
+		p.leases[addr] = &Lease{Addr: addr, Owner: owner, Link: link, Since: time.Now()}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// allocateFrom finds an address in s for owner. p.m must be held.
+func (p *IPAM) allocateFrom(s *subnet, owner string) (string, error) {
+	for addr, reservedFor := range p.reserved {
+		if !reservationCovers(reservedFor, owner) || !s.network.Contains(net.ParseIP(addr)) {
+			continue
+		}
+
+		return addr, p.checkClaim(addr, owner)
+	}
+
+	// without this, a full /64 would be searched address by address
+	if p.free(s).Sign() <= 0 {
+		return "", fmt.Errorf("No more IPs left in virtual network %s", s.network)
+	}
+
+	// each step passes a leased or reserved address or a whole excluded
+	// range, so a lap of s takes no more steps than there are of those
+	ip := dup(s.next)
+	for steps := len(p.leases) + len(p.reserved) + len(p.excluded) + 1; steps > 0; steps-- {
+		if r := p.exclusionOf(ip); r != nil {
+			copy(ip, r.last)
+			s.advance(ip)
+			continue
+		}
+
+		addr := ip.String()
+		if _, leased := p.leases[addr]; !leased && !p.isReserved(addr) {
+			s.next = dup(ip)
+			s.advance(s.next)
+			return addr, nil
+		}
+
+		s.advance(ip)
+	}
+
+	return "", fmt.Errorf("No more IPs left in virtual network %s", s.network)
+}
+
+// claim leases addrs themselves to owner ahead of building its namespace,
+// failing without leasing any if someone else holds or has reserved one.
+// allocate later adopts them for the namespace.
+func (p *IPAM) claim(owner string, addrs []string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var normalized []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("%q is not an address", addr)
+		}
+		addr = normalizeIP(ip).String()
+
+		if err := p.checkClaim(addr, owner); err != nil {
+			return err
+		}
+		normalized = append(normalized, addr)
+	}
+
+	for _, addr := range normalized {
+		if _, ok := p.leases[addr]; !ok {
+			p.leases[addr] = &Lease{Addr: addr, Owner: owner, Since: time.Now()}
+		}
+	}
+
+	return nil
+}
+
+// checkClaim reports why owner can't have addr, if it can't. An address
+// claimed for owner but not yet given to a namespace is its to keep. p.m must
+// be held.
+func (p *IPAM) checkClaim(addr, owner string) error {
+	if !p.assignable(normalizeIP(net.ParseIP(addr))) {
+		return fmt.Errorf("%s is not assignable in the virtual network", addr)
+	}
+
+	if lease, ok := p.leases[addr]; ok && (lease.Owner != owner || lease.Link != "") {
+		return fmt.Errorf("%s is already leased to %s", addr, lease.Owner)
+	}
+
+	if reservedFor, ok := p.reserved[addr]; ok && !reservationCovers(reservedFor, owner) {
+		return fmt.Errorf("%s is reserved for %s", addr, reservedFor)
+	}
+
+	return nil
+}
+
+// reservationCovers reports whether a reservation for name applies to owner.
+// An incoming migration owns its claims as "pid:<pid>@<migration>", so that
+// two migrations never share them, but is covered by a reservation for the
+// process alone.
+func reservationCovers(name, owner string) bool {
+	return name == owner || strings.HasPrefix(owner, name+"@")
+}
+
+// restore re-establishes a lease journaled before a restart
+func (p *IPAM) restore(lease Lease) error {
+	ip := net.ParseIP(lease.Addr)
+	if ip == nil || p.subnetOf(normalizeIP(ip)) == nil {
+		return fmt.Errorf("journaled lease %s is outside the virtual network", lease.Addr)
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.leases[normalizeIP(ip).String()] = &lease
+	return nil
+}
+
+// release returns addrs to the pool
+func (p *IPAM) release(addrs ...string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, addr := range addrs {
+		delete(p.leases, addr)
+	}
+}
+
+// releaseClaims returns the addresses claimed for owner that were never
+// given to a namespace
+func (p *IPAM) releaseClaims(owner string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for addr, lease := range p.leases {
+		if lease.Owner == owner && lease.Link == "" {
+			delete(p.leases, addr)
+		}
+	}
+}
+
+// assign records that pid now uses addrs
+func (p *IPAM) assign(pid int32, addrs ...string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, addr := range addrs {
+		if lease, ok := p.leases[addr]; ok {
+			lease.Pid = pid
+		}
+	}
+}
+
+// releasePid returns the addresses used by pid to the pool, and reports the
+// leases they were held under
+func (p *IPAM) releasePid(pid int32) []Lease {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var released []Lease
+	for addr, lease := range p.leases {
+		if lease.Pid == pid {
+			released = append(released, *lease)
+			delete(p.leases, addr)
+		}
+	}
+
+	return released
+}
+
+// list returns a copy of every lease, IPv4 first and then by address
+func (p *IPAM) list() []Lease {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	leases := make([]Lease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		leases = append(leases, *lease)
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		a := normalizeIP(net.ParseIP(leases[i].Addr))
+		b := normalizeIP(net.ParseIP(leases[j].Addr))
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return bytes.Compare(a, b) < 0
+	})
+
+	return leases
+}
+
+func (p *IPAM) status() PoolStatus {
+	leases := p.list()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	status := PoolStatus{
+		Reservations: map[string]string{},
+		Leases:       leases,
+	}
+
+	for _, r := range p.excluded {
+		if r.first.Equal(r.last) {
+			status.Excluded = append(status.Excluded, r.first.String())
+		} else {
+			status.Excluded = append(status.Excluded, r.first.String()+"-"+r.last.String())
+		}
+	}
+
+	for addr, owner := range p.reserved {
+		status.Reservations[addr] = owner
+	}
+
+	for i, s := range p.subnets {
+		size := rangeSize(s.first, s.last)
+		network := NetworkStatus{Network: s.network.String(), Size: saturate(size), Free: saturate(p.free(s))}
+		status.Networks = append(status.Networks, network)
+
+		// every namespace takes an address from each subnet
+		if i == 0 || network.Free < status.Free {
+			status.Free = network.Free
+		}
+	}
+
+	return status
+}
+
+// free counts the addresses of s that allocate could still hand out. Leased
+// and reserved addresses are never excluded, so they can simply be subtracted
+// along with the excluded ranges. p.m must be held.
+func (p *IPAM) free(s *subnet) *big.Int {
+	unavailable := map[string]bool{}
+	for addr := range p.leases {
+		unavailable[addr] = true
+	}
+	for addr := range p.reserved {
+		unavailable[addr] = true
+	}
+
+	free := new(big.Int).Sub(rangeSize(s.first, s.last), p.excludedSize(s))
+	for addr := range unavailable {
+		if ip := net.ParseIP(addr); ip != nil && s.allocates(normalizeIP(ip)) && !p.isExcluded(normalizeIP(ip)) {
+			free.Sub(free, big.NewInt(1))
+		}
+	}
+
+	return free
+}
+
+// excludedSize counts the addresses of s the excluded ranges cover, counting
+// overlaps once. p.m must be held.
+func (p *IPAM) excludedSize(s *subnet) *big.Int {
+	var clipped []addrRange
+	for _, r := range p.excluded {
+		if len(r.first) != len(s.first) {
+			continue
+		}
+
+		first, last := r.first, r.last
+		if bytes.Compare(first, s.first) < 0 {
+			first = s.first
+		}
+		if bytes.Compare(last, s.last) > 0 {
+			last = s.last
+		}
+		if bytes.Compare(first, last) <= 0 {
+			clipped = append(clipped, addrRange{first: first, last: last})
+		}
+	}
+
+	sort.Slice(clipped, func(i, j int) bool {
+		return bytes.Compare(clipped[i].first, clipped[j].first) < 0
+	})
+
+	total := new(big.Int)
+	var merged *addrRange
+	for i := range clipped {
+		r := clipped[i]
+		if merged != nil && bytes.Compare(r.first, merged.last) <= 0 {
+			if bytes.Compare(r.last, merged.last) > 0 {
+				merged.last = r.last
+			}
+			continue
+		}
+
+		if merged != nil {
+			total.Add(total, rangeSize(merged.first, merged.last))
+		}
+		merged = &r
+	}
+	if merged != nil {
+		total.Add(total, rangeSize(merged.first, merged.last))
+	}
+
+	return total
+}
+
+// subnetOf finds the subnet containing ip, if any
+func (p *IPAM) subnetOf(ip net.IP) *subnet {
+	for _, s := range p.subnets {
+		if len(ip) == len(s.first) && s.network.Contains(ip) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// assignable reports whether ip is one of the pool's hosts and not excluded.
+// p.m must be held, unless p is still being built.
+func (p *IPAM) assignable(ip net.IP) bool {
+	s := p.subnetOf(ip)
+	if s == nil {
+		return false
+	}
+
+	return bytes.Compare(ip, s.hosts.first) >= 0 && bytes.Compare(ip, s.hosts.last) <= 0 && !p.isExcluded(ip)
+}
+
+func (p *IPAM) isExcluded(ip net.IP) bool {
+	return p.exclusionOf(ip) != nil
+}
+
+// exclusionOf finds an excluded range containing ip, if any
+func (p *IPAM) exclusionOf(ip net.IP) *addrRange {
+	for i, r := range p.excluded {
+		if len(ip) != len(r.first) {
+			continue
+		}
+		if bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0 {
+			return &p.excluded[i]
+		}
+	}
+
+	return nil
+}
+
+func (p *IPAM) isReserved(addr string) bool {
+	_, ok := p.reserved[addr]
+	return ok
+}
+
+// allocates reports whether ip is in the part of s this node allocates from
+func (s *subnet) allocates(ip net.IP) bool {
+	return len(ip) == len(s.first) && bytes.Compare(ip, s.first) >= 0 && bytes.Compare(ip, s.last) <= 0
+}
+
+// advance moves ip to the next address this node allocates, wrapping around
+// at the end
+func (s *subnet) advance(ip net.IP) {
+	if bytes.Compare(ip, s.last) >= 0 {
+		copy(ip, s.first)
+		return
+	}
+	inc(ip)
+}
+
+// parseRange reads a single address, a CIDR block, or first-last
+func parseRange(spec string) (addrRange, error) {
+	if strings.Contains(spec, "/") {
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return addrRange{}, err
+		}
+
+		first := normalizeIP(network.IP)
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^network.Mask[i]
+		}
+		return addrRange{first: first, last: last}, nil
+	}
+
+	bounds := strings.SplitN(spec, "-", 2)
+	first := net.ParseIP(strings.TrimSpace(bounds[0]))
+	last := first
+	if len(bounds) == 2 {
+		last = net.ParseIP(strings.TrimSpace(bounds[1]))
+	}
+
+	if first == nil || last == nil {
+		return addrRange{}, fmt.Errorf("bad address range %q", spec)
+	}
+
+	r := addrRange{first: normalizeIP(first), last: normalizeIP(last)}
+	if len(r.first) != len(r.last) || bytes.Compare(r.first, r.last) > 0 {
+		return addrRange{}, fmt.Errorf("bad address range %q", spec)
+	}
+
+	return r, nil
+}
+
+// normalizeIP returns the 4-byte form of IPv4 addresses, so they compare
+// correctly against each other
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+
+	return ip.To16()
+}
+
+func dup(ip net.IP) net.IP {
+	return append(net.IP(nil), ip...)
+}
+
+func dec(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]--
+		if ip[j] != 0xff {
+			break
+		}
+	}
+}
+
+func inc(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			break
+		}
+	}
+}
+
+// rangeSize counts the addresses from first to last
+func rangeSize(first, last net.IP) *big.Int {
+	size := new(big.Int).Sub(new(big.Int).SetBytes(last), new(big.Int).SetBytes(first))
+	return size.Add(size, big.NewInt(1))
+}
+
+// saturate converts n to a uint64, capping it for networks too large to count
+func saturate(n *big.Int) uint64 {
+	if n.Sign() < 0 {
+		return 0
+	}
+	if !n.IsUint64() {
+		return ^uint64(0)
+	}
+
+	return n.Uint64()
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func mustIPAM(t *testing.T, spec string, exclude, allocateFrom []string,
+	reservations []ReservationConfig) *IPAM {
+	t.Helper()
+
+	pool, err := newIPAM(spec, exclude, allocateFrom, reservations)
+	if err != nil {
+		t.Fatalf("newIPAM(%q): %v", spec, err)
+	}
+
+	return pool
+}
+
+func TestNewIPAMRejects(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         string
+		exclude      []string
+		allocateFrom []string
+		reservations []ReservationConfig
+	}{
+		{name: "not a block", spec: "10.0.0.1"},
+		{name: "two IPv4 blocks", spec: "10.0.0.0/24,10.1.0.0/24"},
+		{name: "two IPv6 blocks", spec: "fd00::/64, fd01::/64"},
+		{name: "IPv4 /31", spec: "10.0.0.0/31"},
+		{name: "IPv4 /32", spec: "10.0.0.0/32"},
+		{name: "IPv6 /128", spec: "fd00::/128"},
+		{name: "exclusion outside", spec: "10.0.0.0/24", exclude: []string{"10.0.1.0/24"}},
+		{name: "backwards exclusion", spec: "10.0.0.0/24", exclude: []string{"10.0.0.9-10.0.0.2"}},
+		{name: "mixed family exclusion", spec: "10.0.0.0/24", exclude: []string{"10.0.0.1-fd00::1"}},
+		{name: "allocation range outside", spec: "10.0.0.0/24", allocateFrom: []string{"10.0.1.0/25"}},
+		{name: "two allocation ranges", spec: "10.0.0.0/24",
+			allocateFrom: []string{"10.0.0.0/25", "10.0.0.128/25"}},
+		{name: "empty allocation range", spec: "10.0.0.0/24", allocateFrom: []string{"10.0.0.0/32"}},
+		{name: "reserved network address", spec: "10.0.0.0/24",
+			reservations: []ReservationConfig{{Owner: "a", Addr: "10.0.0.0"}}},
+		{name: "reserved broadcast address", spec: "10.0.0.0/24",
+			reservations: []ReservationConfig{{Owner: "a", Addr: "10.0.0.255"}}},
+		{name: "reserved excluded address", spec: "10.0.0.0/24", exclude: []string{"10.0.0.5"},
+			reservations: []ReservationConfig{{Owner: "a", Addr: "10.0.0.5"}}},
+		{name: "reserved twice", spec: "10.0.0.0/24", reservations: []ReservationConfig{
+			{Owner: "a", Addr: "10.0.0.5"}, {Owner: "b", Addr: "10.0.0.5"}}},
+		{name: "two reservations in one family", spec: "10.0.0.0/24", reservations: []ReservationConfig{
+			{Owner: "a", Addr: "10.0.0.5"}, {Owner: "a", Addr: "10.0.0.6"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newIPAM(test.spec, test.exclude, test.allocateFrom,
+				test.reservations); err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestIPAMAllocatesUntilExhausted(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         string
+		exclude      []string
+		allocateFrom []string
+		want         [][]string // one allocation per entry, then the pool is empty
+	}{
+		{
+			name: "IPv4 /30",
+			spec: "10.0.0.0/30",
+			want: [][]string{{"10.0.0.1"}, {"10.0.0.2"}},
+		},
+		{
+			name: "IPv6 /127 has no broadcast",
+			spec: "fd00::/127",
+			want: [][]string{{"fd00::1"}},
+		},
+		{
+			name:    "exclusions are skipped",
+			spec:    "10.0.0.0/29",
+			exclude: []string{"10.0.0.2-10.0.0.4", "10.0.0.6"},
+			want:    [][]string{{"10.0.0.1"}, {"10.0.0.5"}},
+		},
+		{
+			name:         "allocation range",
+			spec:         "10.0.0.0/24",
+			allocateFrom: []string{"10.0.0.100-10.0.0.102"},
+			want:         [][]string{{"10.0.0.100"}, {"10.0.0.101"}, {"10.0.0.102"}},
+		},
+		{
+			name:         "allocation range stops at the broadcast address",
+			spec:         "10.0.0.0/30",
+			allocateFrom: []string{"10.0.0.0/30"},
+			want:         [][]string{{"10.0.0.1"}, {"10.0.0.2"}},
+		},
+		{
+			name:    "IPv6 /64 excluded all but its last two addresses",
+			spec:    "fd00::/64",
+			exclude: []string{"fd00::1-fd00::ffff:ffff:ffff:fffd"},
+			want:    [][]string{{"fd00::ffff:ffff:ffff:fffe"}, {"fd00::ffff:ffff:ffff:ffff"}},
+		},
+		{
+			name:    "IPv6 /64 with overlapping exclusions",
+			spec:    "fd00::/64",
+			exclude: []string{"fd00::/65", "fd00::8000:0:0:0/66", "fd00::4000:0:0:0-fd00::ffff:ffff:ffff:fffe"},
+			want:    [][]string{{"fd00::ffff:ffff:ffff:ffff"}},
+		},
+		{
+			name:         "IPv6 allocation range in a /48",
+			spec:         "fd00::/48",
+			allocateFrom: []string{"fd00:0:0:1::/64"},
+			exclude:      []string{"fd00:0:0:1::-fd00:0:0:1:ffff:ffff:ffff:fffe"},
+			want:         [][]string{{"fd00::1:ffff:ffff:ffff:ffff"}},
+		},
+		{
+			name: "dual-stack",
+			spec: "10.0.0.0/30,fd00::/126",
+			want: [][]string{{"10.0.0.1", "fd00::1"}, {"10.0.0.2", "fd00::2"}},
+		},
+		{
+			name: "dual-stack runs out with its smaller family",
+			spec: "10.0.0.0/29,fd00::/127",
+			want: [][]string{{"10.0.0.1", "fd00::1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := mustIPAM(t, test.spec, test.exclude, test.allocateFrom, nil)
+
+			for i, want := range test.want {
+				owner := fmt.Sprintf("owner-%d", i)
+				got, err := pool.allocate(owner, "brveth"+owner, nil)
+				if err != nil {
+					t.Fatalf("allocation %d: %v", i, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("allocation %d got %v, want %v", i, got, want)
+				}
+			}
+
+			if got, err := pool.allocate("one-too-many", "brveth-last", nil); err == nil {
+				t.Fatalf("allocated %v from an exhausted pool", got)
+			}
+
+			// a failed allocation leaves nothing behind in any family
+			if leases := pool.list(); len(leases) != len(test.want)*len(test.want[0]) {
+				t.Errorf("%d leases after exhausting the pool: %v", len(leases), leases)
+			}
+		})
+	}
+}
+
+func TestIPAMReusesReleasedAddressesLate(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/29", nil, nil, nil)
+
+	first, _ := pool.allocate("a", "brveth0", nil)
+	pool.allocate("b", "brveth1", nil)
+	pool.release(first...)
+
+	got, err := pool.allocate("c", "brveth2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"10.0.0.3"}) {
+		t.Errorf("got %v, want the search to carry on past the released address", got)
+	}
+
+	// once the search wraps around, the released address comes back
+	for _, owner := range []string{"d", "e", "f"} {
+		if _, err := pool.allocate(owner, "brveth-"+owner, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err = pool.allocate("g", "brveth-g", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, first) {
+		t.Errorf("got %v, want the released %v", got, first)
+	}
+}
+
+func TestIPAMRequestedAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		want      []string // nil if the request must fail
+	}{
+		{"one family requested, other allocated", []string{"10.0.0.9"}, []string{"10.0.0.9", "fd00::2"}},
+		{"IPv4-mapped form", []string{"::ffff:10.0.0.9"}, []string{"10.0.0.9", "fd00::2"}},
+		{"dual-stack pair", []string{"fd00::9", "10.0.0.9"}, []string{"10.0.0.9", "fd00::9"}},
+		{"only the IPv6 address requested", []string{"fd00::9"}, []string{"10.0.0.1", "fd00::9"}},
+		{"leased elsewhere", []string{"10.0.0.7"}, nil},
+		{"excluded", []string{"10.0.0.200"}, nil},
+		{"reserved for someone else", []string{"10.0.0.50"}, nil},
+		{"network address", []string{"10.0.0.0"}, nil},
+		{"outside the network", []string{"10.9.0.1"}, nil},
+		{"two in one family", []string{"10.0.0.9", "10.0.0.10"}, nil},
+		{"garbage", []string{"ten"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := mustIPAM(t, "10.0.0.0/24,fd00::/64", []string{"10.0.0.200-10.0.0.210"}, nil,
+				[]ReservationConfig{{Owner: "other", Addr: "10.0.0.50"}})
+			if err := pool.claim("holder", []string{"10.0.0.7"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := pool.allocate("holder", "brveth-holder", []string{"10.0.0.7"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := pool.allocate("owner", "brveth0", test.requested)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("allocated %v", got)
+				}
+				if leases := pool.list(); len(leases) != 2 {
+					t.Errorf("failed request left leases behind: %v", leases)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIPAMClaims(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/24,fd00::/64", []string{"10.0.0.200"}, nil,
+		[]ReservationConfig{{Owner: "pid:7", Addr: "10.0.0.70"}})
+
+	claimTests := []struct {
+		name  string
+		owner string
+		addrs []string
+		ok    bool
+	}{
+		{"free pair", "pid:1@a", []string{"10.0.0.10", "fd00::10"}, true},
+		{"same owner again", "pid:1@a", []string{"10.0.0.10"}, true},
+		{"another migration of the same pid", "pid:1@b", []string{"10.0.0.10"}, false},
+		{"excluded", "pid:2@a", []string{"10.0.0.200"}, false},
+		{"all or nothing", "pid:3@a", []string{"10.0.0.30", "fd00::10"}, false},
+		{"reservation for the process", "pid:7@c", []string{"10.0.0.70"}, true},
+		{"reservation for another process", "pid:77@c", []string{"10.0.0.70"}, false},
+		{"garbage", "pid:4@a", []string{"ten"}, false},
+	}
+
+	for _, test := range claimTests {
+		if err := pool.claim(test.owner, test.addrs); (err == nil) != test.ok {
+			t.Errorf("%s: claim(%s, %v) = %v", test.name, test.owner, test.addrs, err)
+		}
+	}
+
+	for _, lease := range pool.list() {
+		if lease.Addr == "10.0.0.30" {
+			t.Error("failed claim left 10.0.0.30 leased")
+		}
+	}
+
+	// the namespace adopts its claims
+	got, err := pool.allocate("pid:1@a", "brveth1", []string{"10.0.0.10", "fd00::10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"10.0.0.10", "fd00::10"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	// and once it has, they are no longer anyone's to claim
+	if err := pool.claim("pid:1@a", []string{"10.0.0.10"}); err == nil {
+		t.Error("claimed an address that a namespace holds")
+	}
+
+	// releasing claims leaves addresses in use alone
+	pool.releaseClaims("pid:1@a")
+	pool.releaseClaims("pid:7@c")
+
+	var leased []string
+	for _, lease := range pool.list() {
+		leased = append(leased, lease.Addr)
+	}
+	if want := []string{"10.0.0.10", "fd00::10"}; !reflect.DeepEqual(leased, want) {
+		t.Errorf("leases after releasing claims are %v, want %v", leased, want)
+	}
+}
+
+func TestIPAMReservations(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/29,fd00::/125", nil, []string{"10.0.0.1-10.0.0.3"},
+		[]ReservationConfig{
+			{Owner: "nc", Addr: "10.0.0.2"},
+			{Owner: "nc", Addr: "fd00::5"},
+			{Owner: "pid:9", Addr: "10.0.0.6"},
+		})
+
+	// reservations may sit outside the allocation range
+	got, err := pool.allocate("pid:9@x", "brveth0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.6", "fd00::1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("migrated process got %v, want %v", got, want)
+	}
+
+	got, err = pool.allocate("other", "brveth1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1", "fd00::2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unreserved owner got %v, want %v", got, want)
+	}
+
+	// the search skips over the reservation
+	got, err = pool.allocate("another", "brveth2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.3", "fd00::3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unreserved owner got %v, want %v", got, want)
+	}
+
+	got, err = pool.allocate("nc", "brveth3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.2", "fd00::5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reserved owner got %v, want %v", got, want)
+	}
+
+	// everything in the allocation range is now taken or reserved
+	if got, err := pool.allocate("late", "brveth4", nil); err == nil {
+		t.Errorf("allocated %v", got)
+	}
+}
+
+func TestIPAMPids(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/24,fd00::/64", nil, nil, nil)
+
+	a, _ := pool.allocate("a", "brveth0", nil)
+	b, _ := pool.allocate("b", "brveth1", nil)
+	pool.assign(100, a...)
+	pool.assign(200, b...)
+
+	released := pool.releasePid(100)
+	if len(released) != 2 {
+		t.Fatalf("released %v, want both of pid 100's addresses", released)
+	}
+	for _, lease := range released {
+		if lease.Link != "brveth0" || lease.Owner != "a" {
+			t.Errorf("released %+v", lease)
+		}
+	}
+
+	var left []string
+	for _, lease := range pool.list() {
+		if lease.Pid != 200 {
+			t.Errorf("lease %+v should belong to pid 200", lease)
+		}
+		left = append(left, lease.Addr)
+	}
+	if !reflect.DeepEqual(left, b) {
+		t.Errorf("leases left are %v, want %v", left, b)
+	}
+}
+
+func TestIPAMStatus(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/28,fd00::/120", []string{"10.0.0.1-10.0.0.3", "10.0.0.2-10.0.0.4"},
+		[]string{"fd00::10-fd00::1f"}, []ReservationConfig{{Owner: "r", Addr: "10.0.0.9"}})
+	pool.allocate("a", "brveth0", nil)
+
+	status := pool.status()
+	want := []NetworkStatus{
+		// 14 hosts, 4 excluded, 1 reserved, 1 leased
+		{Network: "10.0.0.0/28", Size: 14, Free: 8},
+		// 16 allocatable, 1 leased
+		{Network: "fd00::/120", Size: 16, Free: 15},
+	}
+	if !reflect.DeepEqual(status.Networks, want) {
+		t.Errorf("networks are %+v, want %+v", status.Networks, want)
+	}
+	if status.Free != 8 {
+		t.Errorf("free is %d, want the smaller family's 8", status.Free)
+	}
+	if !reflect.DeepEqual(status.Reservations, map[string]string{"10.0.0.9": "r"}) {
+		t.Errorf("reservations are %v", status.Reservations)
+	}
+}
+
+func TestIPAMConcurrentAllocateRelease(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/26,fd00::/122", nil, nil, nil)
+
+	var held sync.Map // address -> owner, while the owner holds it
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				owner := fmt.Sprintf("w%d-%d", worker, i)
+				addrs, err := pool.allocate(owner, "brveth-"+owner, nil)
+				if err != nil {
+					t.Errorf("%s: %v", owner, err)
+					return
+				}
+
+				for _, addr := range addrs {
+					if other, loaded := held.LoadOrStore(addr, owner); loaded {
+						t.Errorf("%s given to %s while %s held it", addr, owner, other)
+					}
+				}
+				for _, addr := range addrs {
+					held.Delete(addr)
+				}
+				pool.release(addrs...)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if leases := pool.list(); len(leases) != 0 {
+		t.Errorf("%d leases left after every release", len(leases))
+	}
+}
+
+func TestIPAMConcurrentExhaustion(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/27,fd00::/64", nil, nil, nil)
+
+	var m sync.Mutex
+	given := map[string]string{}
+	failures := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			owner := fmt.Sprintf("owner-%d", i)
+			addrs, err := pool.allocate(owner, "brveth-"+owner, nil)
+
+			m.Lock()
+			defer m.Unlock()
+
+			if err != nil {
+				failures++
+				return
+			}
+			for _, addr := range addrs {
+				if other, ok := given[addr]; ok {
+					t.Errorf("%s given to both %s and %s", addr, other, owner)
+				}
+				given[addr] = owner
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// a /27 has 30 hosts, and every namespace needs one
+	if failures != 20 {
+		t.Errorf("%d allocations failed, want 20", failures)
+	}
+	if leases := pool.list(); len(leases) != 60 {
+		t.Errorf("%d leases, want one of each family for 30 namespaces", len(leases))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+)
+
+const (
+	LogFormatText = "logfmt" // key=value pairs, one line per entry
+	LogFormatJSON = "json"   // one JSON object per entry
+)
+
+var (
+	logger *logrus.Logger = logrus.New()
+)
+
+// setupLogging configures logger from the -log-* flags. An empty file keeps
+// logging on stderr.
+func setupLogging(level, format, file string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(parsed)
+
+	switch format {
+	case LogFormatText:
+		logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	case LogFormatJSON:
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	if file != "" {
+		out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		logger.SetOutput(out)
+	}
+
+	return nil
+}
+
+// log returns an entry carrying the fields that identify the migration. They
+// never change once the migration is created, so m.m need not be held.
+func (m *Migration) log() *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"migration":   m.status.ID,
+		"pid":         m.status.Pid,
+		"source":      m.status.Source,
+		"destination": m.status.Destination,
+	})
+}
+
+// incomingLog returns an entry for the destination's half of migration id,
+// carrying the source and the process's PID there when we know them
+func incomingLog(id string) *logrus.Entry {
+	entry := logger.WithField("migration", id)
+
+	if iincoming, ok := IncomingMigrations.Load(id); ok {
+		if incoming, ok := iincoming.(*incomingMigration); ok {
+			entry = entry.WithFields(logrus.Fields{
+				"pid":    incoming.process.Pid,
+				"source": incoming.source,
+			})
+		}
+	}
+
+	return entry
+}
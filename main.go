@@ -1,59 +1,224 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long in-flight requests get to finish once we're told to stop
+	ShutdownTimeout = 5 * time.Second
 )
 
 var (
 	iface string
 )
 
+// a subcommand of the handoff binary
+type command struct {
+	summary string
+	run     func(args []string)
+}
+
+var commands = map[string]command{
+	"serve":     {"run the node daemon", serve},
+	"register":  {"register a process for migration", registerCommand},
+	"migrate":   {"start migrating a process to another node", migrateCommand},
+	"status":    {"show one migration", statusCommand},
+	"list":      {"list this node's migrations", listCommand},
+	"cancel":    {"cancel a migration in flight", cancelCommand},
+	"addresses": {"show the virtual network's address pool", addressesCommand},
+	"cleanup":   {"revert what a stopped node changed on the host", cleanupCommand},
+}
+
 func main() {
-	ifacePtr := flag.String("iface", "", "public-facing network interface")
-	port := flag.Int("port", 8080, "port to listen on")
-	bridgeNetPtr := flag.String("network-cidr", "172.31.0.0/24",
-		"CIDR block of virtual net ")
+	// the daemon was invoked with bare flags before it had subcommands
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "-") && !isHelpFlag(os.Args[1]) {
+		serve(os.Args[1:])
+		return
+	}
 
-	flag.Parse()
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if !isHelpFlag(os.Args[1]) && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+
+	cmd.run(os.Args[2:])
+}
+
+func isHelpFlag(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
 
-	if *ifacePtr == "" {
-		fmt.Println("error: no iface provided")
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: handoff <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "run handoff <command> -h for a command's flags")
+}
+
+// serve runs the node daemon until it fails or is told to stop
+func serve(args []string) {
+	// config.go
+	config, err := parseServeArgs(args)
+	if err != nil {
+		fmt.Println("error:", err)
 		os.Exit(1)
 	}
 
-	if 0 > *port || 65535 < *port {
-		fmt.Println("error: invalid port provided")
+	if err := joinErrors("invalid configuration", config.validate()); err != nil {
+		fmt.Println("error:", err)
 		os.Exit(1)
 	}
 
-	iface = *ifacePtr
+	// logging.go
+	if err := setupLogging(config.Log.Level, config.Log.Format, config.Log.File); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	nodeConfig = config
+	iface = config.Iface
 
 	// may as well add this check, since we need to be root to run
 	if os.Geteuid() != 0 {
-		fmt.Println("error: must be invoked as root")
-		os.Exit(1)
+		logger.Fatal("must be invoked as root")
+	}
+
+	if err := os.MkdirAll(config.ImageDir, 0755); err != nil {
+		logger.WithError(err).Fatal("unable to create image directory")
+	}
+
+	// inventory.go; must precede anything that changes the host
+	if inventory, err = loadInventory(config.InventoryFile); err != nil {
+		logger.WithError(err).Fatal("unable to load inventory")
 	}
 
 	// make sure the bridge exists
-	err := verifyBridgePresence(*bridgeNetPtr)
+	err = verifyBridgePresence(config.NetworkCIDR)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		logger.WithError(err).Fatal("unable to set up bridge")
+	}
+
+	// overlay.go; joins the bridge to every peer's
+	if config.Overlay.useOverlay() {
+		if err = setupOverlay(); err != nil {
+			logger.WithError(err).Fatal("unable to set up overlay")
+		}
+	}
+
+	// state.go; reloads what we knew before a restart
+	if err = loadState(); err != nil {
+		logger.WithError(err).Fatal("unable to load node state")
 	}
 
 	if err = execInNetNS("nc", []string{"-lk", "0.0.0.0", "5000"}); err != nil {
-		fmt.Println(err)
+		logger.WithError(err).Fatal("unable to start listener")
+	}
+
+	server := &http.Server{Addr: ":" + strconv.Itoa(config.Port)}
+	if config.useTLS() {
+		// tls.go
+		tlsConfig, err := setupTLS(config.TLS.Cert, config.TLS.Key, config.TLS.CA)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to set up TLS")
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	// auth.go; must follow setupTLS so peer requests carry both
+	if config.useAuth() {
+		setupAuth(config.Auth.OperatorToken, config.Auth.PeerToken, config.Auth.MetricsToken)
+	}
+
+	http.HandleFunc("/StartMigration", requireScope(ScopeOperator, StartMigrationHandler))
+	http.HandleFunc("/RegisterProcess", requireScope(ScopeOperator, RegisterProcessHandler))
+	http.HandleFunc("/Migrations", requireScope(ScopeOperator, MigrationsHandler))
+	http.HandleFunc("/Migrations/", requireScope(ScopeOperator, MigrationsHandler))
+	http.HandleFunc("/Events", requireScope(ScopeOperator, EventsHandler))
+	http.HandleFunc("/Addresses", requireScope(ScopeOperator, AddressesHandler))
+	http.Handle("/metrics", requireScope(ScopeMetrics, promhttp.Handler().ServeHTTP))
+	http.HandleFunc("/ForwardTraffic", peerEndpoint(ForwardTrafficHandler))
+	http.HandleFunc("/SlaveStartMigration", peerEndpoint(SlaveStartMigrationHandler))
+	http.HandleFunc("/Checkpoints", peerEndpoint(ReceiveCheckpointHandler))
+	http.HandleFunc("/CheckpointChunks", peerEndpoint(CheckpointChunkHandler))
+	http.HandleFunc("/CommitCheckpoint", peerEndpoint(CommitCheckpointHandler))
+	http.HandleFunc("/PageServer", peerEndpoint(PageServerHandler))
+	http.HandleFunc("/AbortMigration", peerEndpoint(AbortMigrationHandler))
+	http.HandleFunc("/CommitMigration", peerEndpoint(CommitMigrationHandler))
+
+	stopped := make(chan error, 1)
+	go shutdownOnSignal(server, stopped)
+
+	logger.WithField("addr", server.Addr).Info("serving")
+	if config.useTLS() {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.WithError(err).Fatal("server stopped")
+	}
+
+	if err = <-stopped; err != nil {
 		os.Exit(1)
 	}
+	logger.Info("stopped")
+}
+
+// shutdownOnSignal stops server on SIGINT or SIGTERM and reverts what the
+// node changed on the host, leaving its processes' namespaces to a restarted
+// node. A second signal kills the node outright.
+func shutdownOnSignal(server *http.Server, stopped chan<- error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	logger.WithField("signal", sig).Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.WithError(err).Warn("unable to finish in-flight requests")
+	}
+
+	// inventory.go
+	err := inventory.shutdown()
+	if err != nil {
+		logger.WithError(err).Error("unable to revert host changes; run handoff cleanup")
+	}
+	stopped <- err
+}
 
-	http.HandleFunc("/StartMigration", StartMigrationHandler)
-	http.HandleFunc("/RegisterProcess", RegisterProcessHandler)
-	http.HandleFunc("/ForwardTraffic", ForwardTrafficHandler)
-	http.HandleFunc("/SlaveStartMigration", SlaveStartMigrationHandler)
-	http.HandleFunc("/Checkpoints", ReceiveCheckpointHandler)
-	http.ListenAndServe(":"+strconv.Itoa(*port), nil)
+// peerEndpoint guards an endpoint that only other nodes should call
+func peerEndpoint(handler http.HandlerFunc) http.HandlerFunc {
+	return requirePeerCert(requireScope(ScopePeer, handler))
 }
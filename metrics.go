@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	migrationsStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "handoff_migrations_started_total",
+		Help: "Migrations requested from this node.",
+	})
+	migrationsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "handoff_migrations_failed_total",
+		Help: "Migrations from this node that failed and were rolled back.",
+	})
+	migrationsCancelled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "handoff_migrations_cancelled_total",
+		Help: "Migrations from this node cancelled by an operator.",
+	})
+	migrationsCommitted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "handoff_migrations_committed_total",
+		Help: "Migrations from this node that handed the process off.",
+	})
+	migrationsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "handoff_migrations_in_flight",
+		Help: "Migrations from this node that have not yet finished.",
+	})
+
+	dumpDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "handoff_dump_duration_seconds",
+		Help:    "Time CRIU spent writing each dump or pre-dump.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	archiveSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "handoff_checkpoint_archive_bytes",
+		Help:    "Size of each compressed image set sent to a destination.",
+		Buckets: prometheus.ExponentialBuckets(1<<20, 2, 14),
+	})
+	uploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "handoff_checkpoint_upload_duration_seconds",
+		Help:    "Time spent uploading each image set, including resumes.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	})
+
+	framesForwarded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "handoff_shadow_frames_total",
+		Help: "Frames shadowed to destinations.",
+	})
+	bytesForwarded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "handoff_shadow_bytes_total",
+		Help: "Bytes of frames shadowed to destinations.",
+	})
+	forwardFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "handoff_shadow_forward_failures_total",
+		Help: "Shadowed frames that could not be POSTed to /ForwardTraffic.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "handoff_free_ips",
+		Help: "Addresses left in the virtual network's pool.",
+	}, func() float64 {
+		if addressPool == nil {
+			return 0
+		}
+		return float64(addressPool.status().Free)
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "handoff_registered_processes",
+		Help: "Processes registered on this node.",
+	}, func() float64 {
+		count := 0
+		Processes.Range(func(key, value interface{}) bool {
+			count++
+			return true
+		})
+		return float64(count)
+	})
+)
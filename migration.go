@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,8 +12,11 @@ import (
 	"github.com/google/gopacket/pcap"
 	"github.com/shirou/gopsutil/process"
 	"github.com/mholt/archiver"
-	"net/http"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,14 +30,16 @@ type MigrationClock struct {
 }
 
 type SlaveStartMigrationMessage struct {
-	Clock   MigrationClock
-	Process Process
+	Clock       MigrationClock
+	Process     Process
+	MigrationID string   // the source's ID for the migration, for correlating logs
+	Addrs       []string // the process's addresses, which it keeps on the destination
 }
 
 type ShadowTrafficMessage struct {
-	Clock MigrationClock
-	Frame []byte
-	Pid   int32
+	Clock       MigrationClock
+	Frame       []byte
+	MigrationID string
 }
 
 var (
@@ -42,70 +48,141 @@ var (
 )
 
 type criuNotifier struct {
+	migration  *Migration
 	targetAddr string
-	imageDir string
-	pid      int32
+	imageDir   string
 }
 
-func (c criuNotifier) PreDump() error { return nil }
+// criu runs pre-dump just before it freezes the process, and network-lock
+// once it has, if the process has a network namespace to lock. Failing either
+// once the migration is cancelled makes criu abandon the dump.
+func (c criuNotifier) PreDump() error { c.migration.freeze(); return c.migration.ctx.Err() }
 func (c criuNotifier) PreRestore() error { return nil }
 func (c criuNotifier) PostRestore(p int32) error { return nil }
-func (c criuNotifier) NetworkLock() error { return nil }
+func (c criuNotifier) NetworkLock() error { c.migration.freeze(); return c.migration.ctx.Err() }
 func (c criuNotifier) NetworkUnlock() error { return nil }
 func (c criuNotifier) SetupNamespaces(p int32) error { return nil }
 func (c criuNotifier) PostSetupNamespaces() error { return nil }
 func (c criuNotifier) PostResume() error { return nil }
 
-// after we finish a dump, we send it to the destination of the migration
+// cancelNotifier makes criu abandon a dump at its next notification once the
+// migration is cancelled. criu is never killed for a cancel: as a failing dump
+// exits it unlocks the process's network and resumes it, which a killed criu
+// would leave locked.
+type cancelNotifier struct {
+	criu.NoNotify
+	migration *Migration
+}
+
+func (n cancelNotifier) PreDump() error { return n.migration.ctx.Err() }
+func (n cancelNotifier) NetworkLock() error { return n.migration.ctx.Err() }
+func (n cancelNotifier) PostDump() error { return n.migration.ctx.Err() }
+
+// freezeNotifier also records when a dump freezes the process, for dumps
+// whose images are sent some other way
+type freezeNotifier struct {
+	cancelNotifier
+}
+
+func (n freezeNotifier) PreDump() error { n.migration.freeze(); return n.cancelNotifier.PreDump() }
+func (n freezeNotifier) NetworkLock() error { n.migration.freeze(); return n.cancelNotifier.NetworkLock() }
+
+// after we finish a dump, we send it to the destination of the migration.
+// If that fails, so does the dump.
 func (c criuNotifier) PostDump() error {
+	return sendCheckpoint(c.migration, c.targetAddr, c.imageDir, nil)
+}
+
+// sendCheckpoint archives imageDir and uploads it to target. query carries any
+// extra parameters that tell the destination what to do with the images;
+// unless they are a pre-dump, the destination restores from them before
+// replying.
+func sendCheckpoint(migration *Migration, target string, imageDir string,
+	query url.Values) error {
 	compressor := archiver.NewTarGz()
-	if err := compressor.Archive([]string{c.imageDir}, c.imageDir + ".tar.gz"); err != nil {
-		fmt.Println(err)
-		return nil
+	if err := compressor.Archive([]string{imageDir}, imageDir+".tar.gz"); err != nil {
+		return err
 	}
 
-	file, err := os.Open(c.imageDir + ".tar.gz")
-	if err != nil {
-		fmt.Println(err)
-		return nil
+	if info, err := os.Stat(imageDir + ".tar.gz"); err == nil {
+		archiveSize.Observe(float64(info.Size()))
 	}
-	defer file.Close()
 
-	fmt.Println(c.targetAddr)
+	if err := migration.transition(StateTransferring); err != nil {
+		return err
+	}
 
-	res, err := http.Post("http://" + c.targetAddr + "/Checkpoints?pid=" + strconv.Itoa(int(c.pid)), "binary/octet-stream", file)
-	if err != nil {
-		fmt.Println(err)
-		return nil
+	if query == nil {
+		query = url.Values{}
 	}
-	defer res.Body.Close()
+	query.Set("migration", migration.ID())
+	query.Set("images", filepath.Base(imageDir))
 
-	return nil
+	// checkpoint_transfer.go
+	progress := func(uploaded int64) {
+		migration.report(MigrationEvent{Type: EventUpload, Bytes: uploaded})
+	}
+
+	started := time.Now()
+	if err := uploadCheckpoint(migration.ctx, migration.log(), target, query, imageDir+".tar.gz",
+		progress); err != nil {
+		return err
+	}
+	uploadDuration.Observe(time.Since(started).Seconds())
+
+	if query.Get("predump") != "true" {
+		// the destination skips the shadowed frames the original received
+		// before it was frozen
+		if frozenAt, ok := migration.frozenClock(); ok {
+			query.Set("frozen", strconv.FormatUint(frozenAt, 10))
+		}
+
+		// once the destination starts restoring, the migration can't be
+		// cancelled out from under it (migration_state.go)
+		if err := migration.beginHandoff(); err != nil {
+			return err
+		}
+
+		if err := migration.transition(StateRestoring); err != nil {
+			return err
+		}
+	}
+
+	return commitUpload(migration.ctx, target, query)
 }
 
 func registerProcess(p Process) {
+	log := logger.WithField("pid", p.Pid)
+
 	exists, _ := process.PidExists(p.Pid)
 	if !exists {
-		fmt.Println("error: register request for non-existant process")
+		log.Warn("register request for non-existent process")
 		return
 	}
 
 	Processes.Store(p.Pid, p)
-	fmt.Println("registered process", p.Pid)
+	saveState()
+	log.WithFields(logrus.Fields{"tcp": p.TcpPorts, "udp": p.UdpPorts}).Info("registered process")
 }
 
-func doMigration(request StartMigrationRequest) {
+func doMigration(migration *Migration, request StartMigrationRequest) {
 	// step 1: check that we have a matching PID
 	//  assumption: if the process exists it will continue to exist
 	iprocess, exists := Processes.Load(request.Pid)
 	if !exists {
-		fmt.Println("error: migration request for non-registered process")
+		migration.fail(errors.New("migration request for non-registered process"))
 		return
 	}
 
 	process, ok := iprocess.(Process)
 	if !ok {
-		fmt.Println("error: pid not associated with a Process")
+		migration.fail(errors.New("pid not associated with a Process"))
+		return
+	}
+
+	// the other modes track or lazily fetch pages locally
+	if request.StreamPages && request.Mode != "" && request.Mode != MigrationModeFull {
+		migration.fail(errors.New("StreamPages requires a full migration"))
 		return
 	}
 
@@ -113,67 +190,166 @@ func doMigration(request StartMigrationRequest) {
 	iclock, loaded := MigrationClocks.LoadOrStore(request.Pid, &MigrationClock{})
 	if loaded {
 		// this means that we were already doing a migration
-		fmt.Println("error: migration request for a process in-migration")
+		migration.fail(errors.New("migration request for a process in-migration"))
 		return
 	}
 
 	clock, ok := iclock.(*MigrationClock)
 	if !ok {
-		fmt.Println("error: process not associated with *MigrationClock")
+		migration.fail(errors.New("process not associated with *MigrationClock"))
 		return
 	}
+	saveState()
 
+	// from here on, a failure must be rolled back (rollback.go)
 	// step 3: inform Destination that we are migrating the process
-	if err := doInformDestination(request.Destination, process, clock); err != nil {
-		fmt.Println(err)
+	if err := doInformDestination(migration, request.Destination, process, clock); err != nil {
+		rollbackMigration(migration, process, request.Destination, err)
+		return
+	}
+
+	if err := migration.transition(StateShadowing); err != nil {
+		rollbackMigration(migration, process, request.Destination, err)
 		return
 	}
 
+	// shadowing stops when we say so, or when the migration is cancelled
 	mutex := &sync.Mutex{}
-	quitChan := make(chan bool)
+	migration.shadowWith(clock, mutex)
+	shadowCtx, stopShadowing := context.WithCancel(migration.ctx)
+	quitChan := shadowCtx.Done()
 
 	// step 4 a: shadow traffic
-	go forwardProcessTraffic(process, request.Destination, clock, mutex, quitChan)
+	go forwardProcessTraffic(migration, process, request.Destination, clock, mutex, quitChan)
 
 	// step 4 b: (i) checkpoint and (ii) send process
-	// (i)
+	outputDir := filepath.Join(nodeConfig.ImageDir, strconv.FormatInt(time.Now().Unix(), 10))
+
+	var err error
+	switch request.Mode {
+	case "", MigrationModeFull:
+		err = dumpProcess(migration, process, request.Destination, outputDir,
+			request.StreamPages)
+	case MigrationModePreCopy:
+		err = preCopyProcess(migration, process, request.Destination, outputDir)
+	case MigrationModePostCopy:
+		err = postCopyProcess(migration, process, request.Destination, outputDir)
+	default:
+		err = fmt.Errorf("unknown migration mode %q", request.Mode)
+	}
+
+	if err != nil {
+		stopShadowing()
+		rollbackMigration(migration, process, request.Destination, err)
+		return
+	}
+
+	// step 5: the destination has restored its copy, so freeze ours, stop
+	// shadowing, and hand off (commit.go). Cancelling stopped being possible
+	// when the restore began.
+	freezeProcess(process)
+	stopShadowing()
+
+	if err := commitMigration(migration, process, request.Destination); err != nil {
+		if _, refused := err.(commitRefusedError); refused {
+			rollbackMigration(migration, process, request.Destination, err)
+		} else {
+			strandMigration(migration, process, request.Destination, err)
+		}
+		return
+	}
+
+	migration.log().Info("migration committed")
+}
+
+// dumpProcess takes a single full checkpoint of process into outputDir. The
+// criuNotifier ships it to destination once the dump completes. When stream
+// is set the pages go straight to a page server on destination instead.
+func dumpProcess(migration *Migration, process Process, destination, outputDir string,
+	stream bool) error {
 	checkpointer := criu.MakeCriu()
 	leaveRunning := true
-	shellJob := true
-	outputDir := strconv.FormatInt(time.Now().Unix(), 10)
 
 	if err := os.Mkdir(outputDir, 0666); err != nil {
-		fmt.Println(err)
-		quitChan <- true
-		return
+		return err
 	}
 
 	file, err := os.Open(outputDir)
 	if err != nil {
-		fmt.Println(err)
-		quitChan <- true
-		return
+		return err
 	}
 	defer file.Close()
 
-	fd := int32(file.Fd())
-	options := rpc.CriuOpts{
-		LeaveRunning: &leaveRunning,
-		ShellJob: &shellJob,
-		Pid: &process.Pid,
-		ImagesDirFd: &fd,
-		External: []string{fmt.Sprintf("net[%d]:extRootNetNS", netnsInode(request.Pid))}}
+	options := dumpOptions(process, file)
+	options.LeaveRunning = &leaveRunning
+
+	if stream {
+		pageServer, err := requestPageServer(destination, migration.ID(), outputDir)
+		if err != nil {
+			return err
+		}
+		options.Ps = pageServer
+	}
 
 	watcher := criuNotifier{
-		imageDir: outputDir,
-		targetAddr: request.Destination,
-		pid: process.Pid,
+		migration:  migration,
+		imageDir:   outputDir,
+		targetAddr: destination,
+	}
+
+	if err := migration.transition(StateDumping); err != nil {
+		return err
+	}
+
+	return checkpointer.Dump(options, watcher)
+}
+
+// requestPageServer asks destination to start a page server for the image
+// set in imageDir of migration id and returns where the dump should send its
+// pages
+func requestPageServer(destination, id string, imageDir string) (*rpc.CriuPageServerInfo, error) {
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("migration", id)
+	query.Set("images", filepath.Base(imageDir))
+
+	res, err := peerClient.Post(peerURL(destination, "/PageServer?"+query.Encode()),
+		"application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := responseError(res); err != nil {
+		return nil, err
 	}
 
-	if err := checkpointer.Dump(options, watcher); err != nil {
-		fmt.Println(err)
-		quitChan <- true
+	var response PageServerResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
 	}
+
+	return &rpc.CriuPageServerInfo{Address: &host, Port: &response.Port}, nil
+}
+
+// dumpOptions are the CRIU options shared by every dump and pre-dump
+func dumpOptions(process Process, imageDir *os.File) rpc.CriuOpts {
+	fd := int32(imageDir.Fd())
+	pid := process.Pid
+
+	options := rpc.CriuOpts{
+		Pid:         &pid,
+		ImagesDirFd: &fd,
+		External:    []string{fmt.Sprintf("net[%d]:extRootNetNS", netnsInode(process.Pid))}}
+
+	// config.go
+	nodeConfig.CRIU.apply(&options)
+
+	return options
 }
 
 func netnsInode(pid int32) uint64 {
@@ -187,35 +363,47 @@ func netnsInode(pid int32) uint64 {
 	return fstat.Ino 
 }
 
-func doInformDestination(target string, process Process, clock *MigrationClock) error {
+func doInformDestination(migration *Migration, target string, process Process,
+	clock *MigrationClock) error {
 	// increment the clock
 	clock.SourceTime += 1
 
+	// virtual_network.go; the process keeps its addresses wherever it goes
+	addrs, err := namespaceAddrs(process.Pid)
+	if err != nil {
+		return err
+	}
+
 	// create + marshal request
-	slaveMigrationRequest := SlaveStartMigrationMessage{*clock, process}
+	slaveMigrationRequest := SlaveStartMigrationMessage{*clock, process, migration.ID(), addrs}
 	jsonBytes, err := json.Marshal(slaveMigrationRequest)
 	if err != nil {
 		return errors.New("doInformDestination() unable to marhsal json ")
 	}
 
 	// send request
-	_, err = http.Post("http://"+target+"/SlaveStartMigration", "application/json",
+	res, err := peerClient.Post(peerURL(target, "/SlaveStartMigration"), "application/json",
 		bytes.NewBuffer(jsonBytes))
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	return nil
+	// the destination refuses addresses it can't give the process
+	return responseError(res)
 }
 
-func forwardProcessTraffic(p Process, dst string, clck *MigrationClock, m *sync.Mutex,
-	done chan bool) {
+func forwardProcessTraffic(migration *Migration, p Process, dst string, clck *MigrationClock,
+	m *sync.Mutex, done <-chan struct{}) {
+	log := migration.log()
+
 	// iface defined in main.go
 	handle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
 	if err != nil {
-		fmt.Println(err)
+		log.WithError(err).WithField("iface", iface).Error("unable to capture traffic")
 		return
 	}
+	defer handle.Close()
 
 	// build the packet capture filter
 	filterStr := ""
@@ -228,10 +416,11 @@ func forwardProcessTraffic(p Process, dst string, clck *MigrationClock, m *sync.
 	}
 
 	filterStr = strings.Trim(filterStr, " or")
-	fmt.Println("net filter:", filterStr)
+	log = log.WithField("filter", filterStr)
+	log.Debug("shadowing traffic")
 
 	if err := handle.SetBPFFilter(filterStr); err != nil {
-		fmt.Println(err)
+		log.WithError(err).Error("unable to set capture filter")
 		return
 	}
 
@@ -251,24 +440,34 @@ func forwardProcessTraffic(p Process, dst string, clck *MigrationClock, m *sync.
 			m.Unlock()
 
 			// create the message
-			msg := ShadowTrafficMessage{msgClock, packet.Data(), p.Pid}
+			msg := ShadowTrafficMessage{msgClock, packet.Data(), migration.ID()}
 			jsonBytes, err := json.Marshal(msg)
 			if err != nil {
-				fmt.Println(err)
+				log.WithError(err).Error("unable to marshal frame")
 				continue
 			}
 
 			// send the message
-			_, err = http.Post("http://"+dst+"/ForwardTraffic",
+			res, err := peerClient.Post(peerURL(dst, "/ForwardTraffic"),
 				"application/json",
 				bytes.NewBuffer(jsonBytes))
 			if err != nil {
-				fmt.Println(err)
+				log.WithError(err).Warn("unable to forward frame")
+				forwardFailures.Inc()
+				continue
+			}
+			err = responseError(res)
+			res.Body.Close()
+			if err != nil {
+				log.WithError(err).Warn("frame refused")
+				forwardFailures.Inc()
 				continue
 			}
 
+			framesForwarded.Inc()
+			bytesForwarded.Add(float64(len(msg.Frame)))
+			migration.report(MigrationEvent{Type: EventFrame, Clock: &msgClock})
+
 		}
 	}
 }
-
-// TODO - restore the process, rebuild netns
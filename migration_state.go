@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MigrationState string
+
+const (
+	StateInforming    MigrationState = "informing"    // telling the destination to expect the process
+	StateShadowing    MigrationState = "shadowing"    // forwarding traffic, about to dump
+	StateDumping      MigrationState = "dumping"      // CRIU is checkpointing the process
+	StateTransferring MigrationState = "transferring" // uploading images to the destination
+	StateRestoring    MigrationState = "restoring"    // the destination is restoring the process
+	StateCommitted    MigrationState = "committed"    // the process runs on the destination
+	StateFailed       MigrationState = "failed"       // see Error
+	StateCancelled    MigrationState = "cancelled"    // stopped by an operator
+)
+
+// the states each state may move to
+var migrationTransitions = map[MigrationState][]MigrationState{
+	StateInforming:    {StateShadowing, StateFailed, StateCancelled},
+	StateShadowing:    {StateDumping, StateFailed, StateCancelled},
+	StateDumping:      {StateTransferring, StateFailed, StateCancelled},
+	StateTransferring: {StateDumping, StateRestoring, StateFailed, StateCancelled}, // pre-copy dumps again
+	StateRestoring:    {StateCommitted, StateFailed, StateCancelled},
+	StateCommitted:    {},
+	StateFailed:       {},
+	StateCancelled:    {},
+}
+
+// MigrationStatus is what the API reports about a migration
+type MigrationStatus struct {
+	ID          string
+	Pid         int32
+	Destination string
+	Source      string
+	Mode        string
+	State       MigrationState
+	Error       string // why the migration failed, if it did
+	Rollback    string // what was undone after a failure
+	Started     time.Time
+	Updated     time.Time
+	Downtime    time.Duration // from the final dump starting until the destination took over
+	Cancelling  string        // when a requested cancel takes effect, until it has
+}
+
+// Migration tracks one migration from this node
+type Migration struct {
+	status     MigrationStatus
+	ctx        context.Context // done once the migration is cancelled or over
+	cancel     context.CancelFunc
+	handingOff bool            // past the point where cancelling is possible
+	dumped     time.Time       // when the latest dump started
+	clock      *MigrationClock // stamps shadowed frames; nil until shadowing
+	clockMutex *sync.Mutex     // guards clock
+	frozen     bool            // whether the final dump has frozen the process
+	frozenAt   uint64          // clock.SourceTime when it did
+	m          sync.Mutex
+}
+
+var (
+	// maps a migration ID to its *Migration
+	Migrations *sync.Map = new(sync.Map)
+)
+
+func newMigrationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// isMigrationID reports whether id could have come from newMigrationID. A
+// destination names files after the IDs its sources send it.
+func isMigrationID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return id != "" && err == nil
+}
+
+// newMigration registers a migration for request in the informing state
+func newMigration(request StartMigrationRequest) *Migration {
+	now := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	migration := &Migration{
+		ctx:    ctx,
+		cancel: cancel,
+		status: MigrationStatus{
+			ID:          newMigrationID(),
+			Pid:         request.Pid,
+			Destination: request.Destination,
+			Source:      request.Source,
+			Mode:        request.Mode,
+			State:       StateInforming,
+			Started:     now,
+			Updated:     now,
+		},
+	}
+
+	Migrations.Store(migration.status.ID, migration)
+
+	// metrics.go
+	migrationsStarted.Inc()
+	migrationsInFlight.Inc()
+
+	return migration
+}
+
+func (m *Migration) ID() string {
+	return m.status.ID
+}
+
+// transition moves the migration to state, refusing moves the state machine
+// does not allow. Once the migration is cancelled every move is refused, which
+// stops it at its next step.
+func (m *Migration) transition(state MigrationState) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if err := m.ctx.Err(); err != nil && !m.handingOff {
+		return err
+	}
+
+	for _, allowed := range migrationTransitions[m.status.State] {
+		if allowed == state {
+			m.status.State = state
+			m.status.Updated = time.Now()
+			m.publish(MigrationEvent{Type: EventState, State: state})
+
+			switch state {
+			case StateDumping:
+				m.dumped = m.status.Updated
+			case StateTransferring:
+				dumpDuration.Observe(m.status.Updated.Sub(m.dumped).Seconds())
+			case StateCommitted:
+				m.status.Downtime = m.status.Updated.Sub(m.dumped)
+				m.publish(MigrationEvent{Type: EventDowntime, Downtime: m.status.Downtime})
+				migrationsCommitted.Inc()
+				migrationsInFlight.Dec()
+			}
+
+			if m.terminal() {
+				m.cancel()
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("migration %s: illegal transition from %s to %s", m.status.ID,
+		m.status.State, state)
+}
+
+// fail records err and moves the migration to the failed state, or to the
+// cancelled state if an operator stopped it
+func (m *Migration) fail(err error) {
+	m.log().WithError(err).Error("migration failed")
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.terminal() {
+		return
+	}
+
+	m.status.State = StateFailed
+	if m.ctx.Err() != nil {
+		m.status.State = StateCancelled
+	}
+	m.status.Error = err.Error()
+	m.status.Cancelling = ""
+	m.status.Updated = time.Now()
+	m.publish(MigrationEvent{Type: EventState, State: m.status.State, Error: m.status.Error})
+	m.cancel()
+
+	if m.status.State == StateCancelled {
+		migrationsCancelled.Inc()
+	} else {
+		migrationsFailed.Inc()
+	}
+	migrationsInFlight.Dec()
+}
+
+// publish sends event to /Events subscribers on behalf of this migration.
+// m.m must be held.
+func (m *Migration) publish(event MigrationEvent) {
+	event.MigrationID = m.status.ID
+	event.Pid = m.status.Pid
+
+	// events.go
+	Events.publish(event)
+}
+
+// requestCancel stops the migration at its next step. An upload stops at
+// once, but criu only notices between the stages of a dump, so one may run on
+// for a while; the reply says which. Migrations that have already finished, or
+// whose destination has begun restoring, cannot be cancelled.
+func (m *Migration) requestCancel() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.terminal() {
+		return fmt.Errorf("migration %s already %s", m.status.ID, m.status.State)
+	}
+
+	if m.handingOff {
+		return fmt.Errorf("migration %s is already handing off", m.status.ID)
+	}
+
+	switch m.status.State {
+	case StateDumping:
+		m.status.Cancelling = "once criu finishes its current stage of the dump"
+	case StateTransferring:
+		m.status.Cancelling = "now; the upload is abandoned"
+	default:
+		m.status.Cancelling = "at the migration's next step"
+	}
+
+	m.cancel()
+	return nil
+}
+
+// beginHandoff marks the point after which the migration can no longer be
+// cancelled, failing if it already has been. It precedes the final restore,
+// which the destination can't be stopped partway through.
+func (m *Migration) beginHandoff() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+
+	m.handingOff = true
+	return nil
+}
+
+// shadowWith tells the migration which clock stamps its shadowed frames
+func (m *Migration) shadowWith(clock *MigrationClock, clockMutex *sync.Mutex) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.clock = clock
+	m.clockMutex = clockMutex
+}
+
+// freeze records the shadow clock as the final dump freezes the process.
+// Frames stamped up to then reached the original, so the restored copy has
+// them already.
+func (m *Migration) freeze() {
+	m.m.Lock()
+	clock, clockMutex := m.clock, m.clockMutex
+	m.m.Unlock()
+
+	if clock == nil {
+		return
+	}
+
+	clockMutex.Lock()
+	frozenAt := clock.SourceTime
+	clockMutex.Unlock()
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.frozen = true
+	m.frozenAt = frozenAt
+}
+
+// frozenClock reports the shadow clock when the final dump froze the process,
+// if it has
+func (m *Migration) frozenClock() (uint64, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.frozenAt, m.frozen
+}
+
+// terminal reports whether the migration has finished. m.m must be held.
+func (m *Migration) terminal() bool {
+	return len(migrationTransitions[m.status.State]) == 0
+}
+
+// setRollback records what rolling back a failed migration undid
+func (m *Migration) setRollback(notes string) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.status.Rollback = notes
+	m.status.Updated = time.Now()
+}
+
+// report publishes an event about the migration's progress
+func (m *Migration) report(event MigrationEvent) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.publish(event)
+}
+
+func (m *Migration) snapshot() MigrationStatus {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return m.status
+}
+
+// listMigrations reports every migration, oldest first
+func listMigrations() []MigrationStatus {
+	statuses := []MigrationStatus{}
+	Migrations.Range(func(key, value interface{}) bool {
+		if migration, ok := value.(*Migration); ok {
+			statuses = append(statuses, migration.snapshot())
+		}
+		return true
+	})
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Started.Before(statuses[j].Started)
+	})
+
+	return statuses
+}
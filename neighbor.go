@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"net"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const (
+	// announcements are repeated in case the first is lost
+	AnnounceCount    = 3
+	AnnounceInterval = 100 * time.Millisecond
+
+	// an unsolicited advertisement replaces whatever its receivers knew
+	naOverrideFlag = 0x20
+)
+
+// announceMove tells the bridge, and everything behind it, that vif's
+// addresses now live on eth0 in ns. What this node learned about the
+// addresses' previous home is flushed first, then eth0 sends gratuitous ARP
+// and unsolicited neighbor advertisements so that no one waits on a stale
+// cache entry to time out.
+func announceMove(log *logrus.Entry, ns netns.NsHandle, vif VirtualInterface) error {
+	if err := flushStaleNeighbors(vif); err != nil {
+		log.WithError(err).Warn("unable to flush stale neighbors")
+	}
+
+	var frames [][]byte
+	for _, addr := range vif.Addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return errors.New("announceMove(): cannot parse namespace IP")
+		}
+
+		var frame []byte
+		var err error
+		if ip.To4() != nil {
+			frame, err = gratuitousARP(vif.HardwareAddr, ip.To4())
+		} else {
+			frame, err = unsolicitedNA(vif.HardwareAddr, ip)
+		}
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+	}
+
+	// the socket stays in the namespace it was opened in
+	handle, err := openInNetNs(ns, "eth0")
+	if err != nil {
+		return err
+	}
+
+	// only the first round holds up the restore
+	go func() {
+		defer handle.Close()
+
+		for i := 0; i < AnnounceCount; i++ {
+			if i > 0 {
+				time.Sleep(AnnounceInterval)
+			}
+
+			for _, frame := range frames {
+				if err := handle.WritePacketData(frame); err != nil {
+					log.WithError(err).Warn("unable to announce address")
+				}
+			}
+		}
+	}()
+
+	log.WithField("addrs", vif.Addrs).Debug("announced addresses")
+	return nil
+}
+
+// flushStaleNeighbors forgets the neighbor entries that map vif's addresses
+// to some other MAC, along with whatever the bridge learned about where that
+// MAC lives
+func flushStaleNeighbors(vif VirtualInterface) error {
+	bridge, err := netlink.LinkByName(nodeConfig.Bridge)
+	if err != nil {
+		return err
+	}
+	bridgeIndex := bridge.Attrs().Index
+
+	addrs := map[string]bool{}
+	for _, addr := range vif.Addrs {
+		addrs[addr] = true
+	}
+
+	neighbors, err := netlink.NeighList(bridgeIndex, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	stale := map[string]bool{}
+	for i := range neighbors {
+		neighbor := &neighbors[i]
+		if neighbor.IP == nil || !addrs[neighbor.IP.String()] || len(neighbor.HardwareAddr) == 0 ||
+			bytes.Equal(neighbor.HardwareAddr, vif.HardwareAddr) {
+			continue
+		}
+
+		stale[neighbor.HardwareAddr.String()] = true
+		if err := netlink.NeighDel(neighbor); err != nil {
+			return err
+		}
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	entries, err := netlink.NeighList(0, syscall.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if entry.MasterIndex != bridgeIndex || !stale[entry.HardwareAddr.String()] ||
+			entry.State&netlink.NUD_PERMANENT != 0 {
+			continue
+		}
+
+		if err := netlink.NeighDel(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openInNetNs opens device, which lives in ns, for writing frames
+func openInNetNs(ns netns.NsHandle, device string) (*pcap.Handle, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	oldns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer oldns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := netns.Set(oldns); err != nil {
+			panic("openInNetNs: error restoring old namespace")
+		}
+	}()
+
+	return pcap.OpenLive(device, 1600, false, pcap.BlockForever)
+}
+
+// gratuitousARP builds an ARP request that announces ip at mac
+func gratuitousARP(mac net.HardwareAddr, ip net.IP) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   mac,
+		SourceProtAddress: ip,
+		DstHwAddress:      make(net.HardwareAddr, 6),
+		DstProtAddress:    ip,
+	}
+
+	return serializeFrame(eth, arp)
+}
+
+// unsolicitedNA builds a neighbor advertisement, sent to all nodes, that
+// announces ip at mac
+func unsolicitedNA(mac net.HardwareAddr, ip net.IP) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      ip,
+		DstIP:      net.IPv6linklocalallnodes,
+	}
+
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(ip6)
+
+	advertisement := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         naOverrideFlag,
+		TargetAddress: ip,
+		Options: layers.ICMPv6Options{
+			{Type: layers.ICMPv6OptTargetAddress, Data: mac},
+		},
+	}
+
+	return serializeFrame(eth, ip6, icmp, advertisement)
+}
+
+func serializeFrame(frameLayers ...gopacket.SerializableLayer) ([]byte, error) {
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buffer, options, frameLayers...); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
@@ -2,18 +2,37 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
-	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	MigrationModeFull     = "full"     // a single stop-and-copy dump (the default)
+	MigrationModePreCopy  = "precopy"  // iterative pre-dumps, then stop-and-copy
+	MigrationModePostCopy = "postcopy" // restore first, then fault pages in lazily
 )
 
 type StartMigrationRequest struct {
 	Pid         int32  // PID of process we're migration
 	Destination string // Location we're migrating to
 	Source      string // Location we're migrating from
+	Mode        string // one of the MigrationMode constants
+	StreamPages bool   // dump pages straight into a page server on the destination
+}
+
+type StartMigrationResponse struct {
+	ID string // identifies the migration to /Migrations/{id}
+}
+
+type PageServerResponse struct {
+	Port int32 // port the destination's page server listens on
 }
 
 type Process struct {
@@ -38,7 +57,7 @@ func RegisterProcessHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := decoder.Decode(&request)
 	if err != nil {
-		fmt.Println("RegisterProcess(): poorly formatted request")
+		logger.WithError(err).Warn("RegisterProcess(): poorly formatted request")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -58,12 +77,64 @@ func StartMigrationHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := decoder.Decode(&request)
 	if err != nil {
-		fmt.Println("StartMigration(): poorly formatted request")
+		logger.WithError(err).Warn("StartMigration(): poorly formatted request")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	go doMigration(request)
+	// peers may be named rather than addressed (config.go)
+	request.Destination = nodeConfig.resolvePeer(request.Destination)
+
+	// migration_state.go
+	migration := newMigration(request)
+	json.NewEncoder(w).Encode(StartMigrationResponse{ID: migration.ID()})
+
+	go doMigration(migration, request)
+}
+
+func MigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Migrations() MUST be GET'd, or DELETE'd to cancel one
+	if r.Method != "GET" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /Migrations lists every migration, /Migrations/{id} reports one
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/Migrations"), "/")
+	if id == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		json.NewEncoder(w).Encode(listMigrations())
+		return
+	}
+
+	imigration, ok := Migrations.Load(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	migration, ok := imigration.(*Migration)
+	if !ok {
+		logger.WithField("migration", id).Error("id not associated with *Migration")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the migration notices at its next step and rolls itself back; the
+	// reply's Cancelling says when that will be
+	if r.Method == "DELETE" {
+		if err := migration.requestCancel(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	json.NewEncoder(w).Encode(migration.snapshot())
 }
 
 func ForwardTrafficHandler(w http.ResponseWriter, r *http.Request) {
@@ -78,32 +149,43 @@ func ForwardTrafficHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := decoder.Decode(&request)
 	if err != nil {
-		fmt.Println("ForwardTraffic(): poorly formatted request")
+		logger.WithError(err).Warn("ForwardTraffic(): poorly formatted request")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	// update the vector clock
-	iclock, ok := MigrationClocks.Load(request.Pid)
-	if !ok {
-		fmt.Printf("ForwardTraffic(): no process %d for migration\n", request.Pid)
+	incoming, err := loadIncoming(request.MigrationID)
+	if err != nil {
+		logger.WithField("migration", request.MigrationID).Warn("ForwardTraffic(): no such migration")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	clock, ok := iclock.(*MigrationClock)
+	// messages race each other, so only move the clock forward
+	mutex.Lock()
+	clock := incoming.clock
+	clock.DestinationTime += 1
+	if request.Clock.SourceTime > clock.SourceTime {
+		clock.SourceTime = request.Clock.SourceTime
+	}
+	mutex.Unlock()
+
+	// shadow_traffic.go
+	ibuffer, ok := ShadowBuffers.Load(request.MigrationID)
 	if !ok {
-		fmt.Println("error: process not associated with *MigrationClock")
+		incomingLog(request.MigrationID).Warn("ForwardTraffic(): no shadow buffer")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	mutex.Lock()
-	clock.DestinationTime += 1
-	clock.SourceTime = request.Clock.SourceTime
-	mutex.Unlock()
+	buffer, ok := ibuffer.(*shadowBuffer)
+	if !ok {
+		incomingLog(request.MigrationID).Error("migration not associated with *shadowBuffer")
+		return
+	}
 
-	// TODO - actually forward the traffic!
-	fmt.Println(request)
+	buffer.push(request)
 }
 
 func SlaveStartMigrationHandler(w http.ResponseWriter, r *http.Request) {
@@ -118,46 +200,354 @@ func SlaveStartMigrationHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := decoder.Decode(&request)
 	if err != nil {
-		fmt.Println("SlaveStartMigration(): poorly formatted request")
+		logger.WithError(err).Warn("SlaveStartMigration(): poorly formatted request")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// Processes and MigrationClocks are defined in migration.go
-	Processes.Store(request.Process.Pid, request.Process)
-	MigrationClocks.Store(request.Process.Pid, &request.Clock)
+	// the ID names our files, and everything we build for the migration
+	id := request.MigrationID
+	if !isMigrationID(id) {
+		logger.WithField("migration", id).Warn("SlaveStartMigration(): bad migration ID")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// remembered so our logs can be matched against the source's
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+
+	incoming := &incomingMigration{
+		migrationID: id,
+		source:      source,
+		process:     request.Process,
+		clock:       &request.Clock,
+		addrs:       request.Addrs,
+	}
+	if _, loaded := IncomingMigrations.LoadOrStore(id, incoming); loaded {
+		logger.WithField("migration", id).Warn("SlaveStartMigration(): migration already started")
+		http.Error(w, "migration already started", http.StatusConflict)
+		return
+	}
+	log := incomingLog(id)
+
+	// ipam.go; the process's addresses must be free here before it is
+	// worth starting
+	if err := addressPool.claim(migrationOwner(request.Process.Pid, id), request.Addrs); err != nil {
+		IncomingMigrations.Delete(id)
+		log.WithError(err).Warn("SlaveStartMigration(): address conflict")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 
-	fmt.Printf("Migration for %d started...\n", request.Process.Pid)
+	ShadowBuffers.Store(id, newShadowBuffer(id, request.Clock))
+	saveState()
 
-	// TODO - create a new network namespace.
-	// Then, create a veth pair and connect to bridge. do not update route tables yet.
-	// Write the raw ethernet frame to the veth pair
+	log.Info("incoming migration started")
 }
 
 func ReceiveCheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	// Checkpoints() MUST be POST'd to!
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, images, err := parseImageSet(r)
+	if err != nil {
+		logger.WithError(err).Warn("ReceiveCheckpoint(): bad image set")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var manifest CheckpointManifest
+
+	err = decoder.Decode(&manifest)
+	if err != nil {
+		incomingLog(id).WithError(err).Warn("ReceiveCheckpoint(): poorly formatted manifest")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// checkpoint_transfer.go
+	status, err := startCheckpointUpload(id, images, manifest)
+	if err != nil {
+		incomingLog(id).WithError(err).Warn("ReceiveCheckpoint(): rejected manifest")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+func CheckpointChunkHandler(w http.ResponseWriter, r *http.Request) {
+	// CheckpointChunks() MUST be PUT to!
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, images, err := parseImageSet(r)
+	if err != nil {
+		logger.WithError(err).Warn("CheckpointChunk(): bad image set")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	index, err := strconv.Atoi(r.Form.Get("index"))
+	if err != nil {
+		incomingLog(id).Warn("CheckpointChunk(): non-numeric index")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// checkpoint_transfer.go
+	if err := receiveCheckpointChunk(id, images, index, r.Body); err != nil {
+		incomingLog(id).WithError(err).WithField("chunk", index).Warn("CheckpointChunk(): rejected chunk")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+}
+
+func CommitCheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	// CommitCheckpoint() MUST be POST'd to!
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, images, err := parseImageSet(r)
+	if err != nil {
+		logger.WithError(err).Warn("CommitCheckpoint(): bad image set")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// never restore from an archive we can't vouch for
+	if err := commitCheckpoint(id, images); err != nil {
+		incomingLog(id).WithError(err).Error("CommitCheckpoint(): incomplete upload")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// pre-dumps only need to be in place for the final dump to reference
+	if r.Form.Get("predump") == "true" {
+		if _, err := unpackCheckpoint(id, images); err != nil {
+			incomingLog(id).WithError(err).Error("unable to unpack pre-dump")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// post-copy sources serve the remaining pages from their own page server
+	var pageServer string
+	if port := r.Form.Get("pageport"); port != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			incomingLog(id).WithError(err).Warn("CommitCheckpoint(): can't determine source address")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pageServer = net.JoinHostPort(host, port)
+	}
+
+	// shadowed frames up to this clock reached the source before it froze
+	var frozenAt uint64
+	if frozen := r.Form.Get("frozen"); frozen != "" {
+		frozenAt, err = strconv.ParseUint(frozen, 10, 64)
+		if err != nil {
+			incomingLog(id).WithError(err).Warn("CommitCheckpoint(): bad frozen clock")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	// restore.go; the source learns whether the migration took from our reply
+	if err := doRestore(id, images, pageServer, frozenAt); err != nil {
+		incomingLog(id).WithError(err).Error("restore failed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func AbortMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	// AbortMigration() MUST be POST'd to!
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
 	if err := r.ParseForm(); err != nil {
-		fmt.Println("ReceiveCheckpointHandler(): error parsing")
+		logger.WithError(err).Warn("AbortMigration(): error parsing")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	spid, ok := r.Form["pid"]
-	if !ok {
-		fmt.Println("ReceiveCheckpointHandler(): no pid")
+	id := r.Form.Get("migration")
+	if id == "" {
+		logger.Warn("AbortMigration(): no migration ID")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// rollback.go; the migration is forgotten by the time we could log it
+	log := incomingLog(id)
+	if err := abortIncomingMigration(id); err != nil {
+		log.WithError(err).Error("unable to abort migration")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func CommitMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	// CommitMigration() MUST be POST'd to!
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logger.WithError(err).Warn("CommitMigration(): error parsing")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id := r.Form.Get("migration")
+	if id == "" {
+		logger.Warn("CommitMigration(): no migration ID")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	pid, err := strconv.ParseInt(spid[0], 10, 32)
+	// commit.go; the source rolls back on a conflict, but not on a migration
+	// we have no record of
+	log := incomingLog(id)
+	if err := commitIncomingMigration(id); err == errNoMigration {
+		log.WithError(err).Error("unable to commit migration")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).Error("unable to commit migration")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Info("incoming migration committed")
+}
+
+func PageServerHandler(w http.ResponseWriter, r *http.Request) {
+	// PageServer() MUST be POST'd to!
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, images, err := parseImageSet(r)
 	if err != nil {
-		fmt.Println("ReceiveCheckpointHandler(): non-numeric PID")
+		logger.WithError(err).Warn("PageServer(): bad image set")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	file, err := os.Create(fmt.Sprintf("./%d.tar.gz", pid))
+	// restore.go
+	port, err := startPageServer(id, images)
 	if err != nil {
-		fmt.Println("ReceiveCheckpointHandler(): can't create file")
+		incomingLog(id).WithError(err).Error("unable to start page server")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(PageServerResponse{Port: port})
+}
+
+func AddressesHandler(w http.ResponseWriter, r *http.Request) {
+	// Addresses() MUST be GET'd!
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	defer file.Close()
 
-	io.Copy(file, r.Body)
+	// ipam.go
+	json.NewEncoder(w).Encode(addressPool.status())
+}
+
+// parseImageSet reads the migration and images parameters that identify an
+// image set uploaded by a source. Only migrations we accepted may upload.
+func parseImageSet(r *http.Request) (string, string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", "", errors.New("error parsing")
+	}
+
+	id := r.Form.Get("migration")
+	if _, ok := IncomingMigrations.Load(id); !ok {
+		return "", "", fmt.Errorf("no migration %q", id)
+	}
+
+	// images names the directory the source dumped into; it must not escape
+	// the restore directory
+	images := r.Form.Get("images")
+	if !isPlainName(images) {
+		return "", "", errors.New("bad image directory")
+	}
+
+	return id, images, nil
+}
+
+// isPlainName reports whether name is safe to use as a single path element
+func isPlainName(name string) bool {
+	return name != "" && name != "." && name != ".." && name == filepath.Base(name)
+}
+
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	// Events() MUST be GET'd!
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// ?migration=<id> limits the stream to one migration
+	only := r.URL.Query().Get("migration")
+
+	// events.go
+	subscriber := Events.subscribe()
+	defer Events.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EventHeartbeatPeriod)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+
+		case event := <-subscriber:
+			if only != "" && event.MigrationID != only {
+				continue
+			}
+
+			jsonBytes, err := json.Marshal(event)
+			if err != nil {
+				logger.WithError(err).Error("unable to marshal event")
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, jsonBytes)
+			flusher.Flush()
+		}
+	}
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"syscall"
+)
+
+const (
+	DefaultVXLANPort   = 4789 // assigned by IANA
+	DefaultVXLANDevice = "handoff-vxlan"
+	MaxVNI             = 1<<24 - 1
+
+	// outer Ethernet, IP, UDP and VXLAN headers
+	vxlanOverhead = 50
+)
+
+// setupOverlay joins the bridge to the VXLAN segment shared with every peer,
+// so that a namespace's address reaches it on whichever node it lives. Frames
+// for an unknown MAC are flooded to every peer's endpoint, and the VXLAN
+// device learns where each MAC lives from the replies.
+func setupOverlay() error {
+	overlay := nodeConfig.Overlay
+
+	public, err := netlink.LinkByName(nodeConfig.Iface)
+	if err != nil {
+		return err
+	}
+
+	local, err := overlayLocalAddr(public)
+	if err != nil {
+		return err
+	}
+
+	bridge, err := netlink.LinkByName(nodeConfig.Bridge)
+	if err != nil {
+		return err
+	}
+
+	log := logger.WithFields(logrus.Fields{"device": overlay.Device, "vni": overlay.VNI})
+
+	created := false
+	link, err := netlink.LinkByName(overlay.Device)
+	if err != nil {
+		vxlan := &netlink.Vxlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: overlay.Device,
+				MTU:  public.Attrs().MTU - vxlanOverhead},
+			VxlanId:      overlay.VNI,
+			VtepDevIndex: public.Attrs().Index,
+			SrcAddr:      local,
+			Port:         overlay.Port,
+			Learning:     true,
+		}
+		if err := netlink.LinkAdd(vxlan); err != nil {
+			return err
+		}
+		link = vxlan
+		log.WithField("local", local).Info("created VXLAN device")
+
+		// inventory.go; its flood entries go with it
+		inventory.record(Resource{Kind: ResourceLink, Name: overlay.Device})
+		created = true
+	} else if vxlan, ok := link.(*netlink.Vxlan); !ok || vxlan.VxlanId != overlay.VNI {
+		return fmt.Errorf("%s exists and is not VXLAN %d", overlay.Device, overlay.VNI)
+	}
+
+	// the bridge shrinks its MTU to fit, and namespaces follow the bridge
+	if err := netlink.LinkSetMaster(link, bridge); err != nil {
+		return err
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+
+	vteps := map[string]bool{}
+	for _, peer := range nodeConfig.Peers {
+		vtep, err := peerVTEP(peer, local)
+		if err != nil {
+			return err
+		}
+		vteps[vtep.String()] = true
+
+		// an all-zeros entry is where broadcasts and unknown MACs go
+		entry := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           vtep,
+			HardwareAddr: make(net.HardwareAddr, 6),
+		}
+		err = netlink.NeighAppend(entry)
+		if err != nil && err != syscall.EEXIST {
+			return err
+		}
+		if err == nil && !created {
+			inventory.record(Resource{Kind: ResourceFDB, Name: overlay.Device, Addr: vtep.String()})
+		}
+		log.WithFields(logrus.Fields{"peer": peer.Name, "vtep": vtep}).Debug("joined peer")
+	}
+
+	// peers dropped from the config since the device was made
+	entries, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if entry.IP == nil || vteps[entry.IP.String()] || !isZeroMAC(entry.HardwareAddr) {
+			continue
+		}
+
+		log.WithField("vtep", entry.IP).Info("removing former peer")
+		if err := netlink.NeighDel(entry); err != nil {
+			return err
+		}
+	}
+
+	if len(nodeConfig.Peers) > 0 && len(nodeConfig.IPAM.AllocateFrom) == 0 {
+		log.Warn("no ipam allocate_from range; peers on the overlay may hand out the same address")
+	}
+
+	log.WithField("peers", len(vteps)).Info("overlay ready")
+	return nil
+}
+
+// overlayLocalAddr is the configured endpoint, or else the first global
+// address on public, preferring IPv4
+func overlayLocalAddr(public netlink.Link) (net.IP, error) {
+	if nodeConfig.Overlay.Local != "" {
+		return net.ParseIP(nodeConfig.Overlay.Local), nil
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		addrs, err := netlink.AddrList(public, family)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.IsGlobalUnicast() {
+				return addr.IP, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%s has no address to send VXLAN from", nodeConfig.Iface)
+}
+
+// peerVTEP is where peer's end of the overlay is, in the same address family
+// as local
+func peerVTEP(peer PeerConfig, local net.IP) (net.IP, error) {
+	if peer.VTEP != "" {
+		return net.ParseIP(peer.VTEP), nil
+	}
+
+	host, _, err := net.SplitHostPort(peer.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("peer %q: %v", peer.Name, err)
+	}
+
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (local.To4() == nil) {
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("peer %q has no address of the same family as %s", peer.Name, local)
+}
+
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return len(mac) > 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/checkpoint-restore/go-criu"
+	"github.com/checkpoint-restore/go-criu/rpc"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	LazyPagesStartupWait = 5 * time.Second // how long to wait for criu lazy-pages
+)
+
+// postCopyProcess dumps everything but process's memory into outputDir and
+// ships it to destination, then serves the memory from a page server until
+// the restored process has faulted all of it in. Once the destination has
+// restored, the original is gone for good, so later failures are only logged.
+func postCopyProcess(migration *Migration, process Process, destination,
+	outputDir string) error {
+	// each migration serves pages on a port of its own
+	pagePort, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(outputDir, 0666); err != nil {
+		return err
+	}
+
+	file, err := os.Open(outputDir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// criu writes to the status fd once its page server is accepting
+	// connections, which is when the non-memory images are complete
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer statusRead.Close()
+
+	if err := clearCloseOnExec(int(statusWrite.Fd())); err != nil {
+		statusWrite.Close()
+		return err
+	}
+
+	checkpointer := criu.MakeCriu()
+	lazyPages := true
+	port := int32(pagePort)
+	statusFd := int32(statusWrite.Fd())
+
+	options := dumpOptions(process, file)
+	options.LazyPages = &lazyPages
+	options.StatusFd = &statusFd
+	options.Ps = &rpc.CriuPageServerInfo{Port: &port}
+
+	if err := migration.transition(StateDumping); err != nil {
+		statusWrite.Close()
+		return err
+	}
+
+	// the dump does not return until every page has been sent
+	dumpErr := make(chan error, 1)
+	go func() {
+		dumpErr <- checkpointer.Dump(options, freezeNotifier{cancelNotifier{migration: migration}})
+		statusWrite.Close()
+	}()
+
+	status := make([]byte, 1)
+	if _, err := statusRead.Read(status); err != nil {
+		if dumpFailed := <-dumpErr; dumpFailed != nil {
+			return dumpFailed
+		}
+		return errors.New("postCopyProcess(): criu exited before serving pages")
+	}
+
+	query := url.Values{"pageport": {strconv.Itoa(pagePort)}}
+	if err := sendCheckpoint(migration, destination, outputDir, query); err != nil {
+		// criu holds the process seized for a page client that will never
+		// connect, and SIGCONT can't resume a seized task. Killing criu
+		// detaches it, so the rollback can resume it, and frees the port.
+		if _, killErr := killPipeHolders(statusRead); killErr != nil {
+			migration.log().WithError(killErr).Error("unable to stop the lazy dump")
+			return err
+		}
+		<-dumpErr
+		return err
+	}
+
+	// the restored copy is the only one now; pages it never received show up
+	// as faults there, and rolling back would lose the process entirely
+	if err := <-dumpErr; err != nil {
+		migration.log().WithError(err).Error("lazy dump failed after the restore")
+	}
+
+	return nil
+}
+
+// killPipeHolders kills every other process holding an end of pipe, and
+// returns how many there were
+func killPipeHolders(pipe *os.File) (int, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(pipe.Fd()), &stat); err != nil {
+		return 0, err
+	}
+	target := fmt.Sprintf("pipe:[%d]", stat.Ino)
+
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return 0, err
+	}
+
+	killed := map[int]bool{}
+	for _, fd := range fds {
+		pid, err := strconv.Atoi(strings.Split(fd, "/")[2])
+		if err != nil || pid == os.Getpid() || killed[pid] {
+			continue
+		}
+
+		if link, err := os.Readlink(fd); err != nil || link != target {
+			continue
+		}
+
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return len(killed), err
+		}
+		killed[pid] = true
+	}
+
+	return len(killed), nil
+}
+
+// freePort finds a TCP port that nothing is listening on
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startLazyPages runs the criu lazy-pages daemon that fetches pages for a
+// post-copy restore from pageServer, and waits for it to come up
+func startLazyPages(imageDir, pageServer string) error {
+	host, port, err := net.SplitHostPort(pageServer)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("criu", "lazy-pages", "--page-server",
+		"--address", host, "--port", port, "--images-dir", imageDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// the restore connects to the daemon over this socket
+	socket := filepath.Join(imageDir, "lazy-pages.socket")
+	deadline := time.Now().Add(LazyPagesStartupWait)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(socket); err == nil {
+			go cmd.Wait()
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	return errors.New("startLazyPages(): criu lazy-pages did not start")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// a lazy dump that outlives a failed upload is stopped by killing whatever
+// holds its status pipe
+func TestKillPipeHolders(t *testing.T) {
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statusRead.Close()
+
+	cmd := exec.Command("sleep", "60")
+	cmd.ExtraFiles = []*os.File{statusWrite}
+	if err := cmd.Start(); err != nil {
+		t.Skip("can't start sleep:", err)
+	}
+	statusWrite.Close()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	killed, err := killPipeHolders(statusRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if killed != 1 {
+		t.Errorf("killed %d processes, want 1", killed)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("the pipe's holder is still running")
+	}
+
+	// we hold the other end ourselves, and live
+	if killed, err := killPipeHolders(statusRead); err != nil || killed != 0 {
+		t.Errorf("killPipeHolders() = %d, %v once nobody else holds the pipe", killed, err)
+	}
+}
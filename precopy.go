@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"github.com/checkpoint-restore/go-criu"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	PreCopyMaxIterations  = 8        // pre-dumps to take before giving up on convergence
+	PreCopyDirtyThreshold = 16 << 20 // bytes of dirty pages small enough to stop-and-copy
+)
+
+// preCopyProcess repeatedly pre-dumps process into outputDir, shipping each
+// incremental image set to destination, until the pages dirtied between
+// iterations are few enough for a short final dump
+func preCopyProcess(migration *Migration, process Process, destination,
+	outputDir string) error {
+	if err := os.Mkdir(outputDir, 0666); err != nil {
+		return err
+	}
+
+	var parent string
+	var lastDirty int64
+
+	for i := 1; i <= PreCopyMaxIterations; i++ {
+		if err := migration.transition(StateDumping); err != nil {
+			return err
+		}
+
+		imageDir := filepath.Join(outputDir, fmt.Sprintf("pre-%d", i))
+		if err := preDumpProcess(migration, process, imageDir, parent); err != nil {
+			return err
+		}
+
+		query := url.Values{"predump": {"true"}}
+		if err := sendCheckpoint(migration, destination, imageDir, query); err != nil {
+			return err
+		}
+		parent = filepath.Join("..", filepath.Base(imageDir))
+
+		dirty, err := pagesSize(imageDir)
+		if err != nil {
+			return err
+		}
+		migration.log().WithFields(logrus.Fields{"iteration": i, "dirty": dirty}).Info("pre-dump sent")
+
+		// stop once the dirty set is small or has stopped shrinking
+		if dirty <= PreCopyDirtyThreshold || (i > 1 && dirty >= lastDirty) {
+			break
+		}
+		lastDirty = dirty
+	}
+
+	// stop-and-copy whatever was dirtied since the last pre-dump
+	imageDir := filepath.Join(outputDir, "final")
+	if err := os.Mkdir(imageDir, 0666); err != nil {
+		return err
+	}
+
+	file, err := os.Open(imageDir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checkpointer := criu.MakeCriu()
+	leaveRunning := true
+	trackMem := true
+
+	options := dumpOptions(process, file)
+	options.LeaveRunning = &leaveRunning
+	options.TrackMem = &trackMem
+	options.ParentImg = &parent
+
+	watcher := criuNotifier{
+		migration:  migration,
+		imageDir:   imageDir,
+		targetAddr: destination,
+	}
+
+	if err := migration.transition(StateDumping); err != nil {
+		return err
+	}
+
+	return checkpointer.Dump(options, watcher)
+}
+
+// preDumpProcess takes an incremental memory-only checkpoint of process into
+// imageDir. parent is the previous pre-dump relative to imageDir, if any.
+func preDumpProcess(migration *Migration, process Process, imageDir, parent string) error {
+	if err := os.Mkdir(imageDir, 0666); err != nil {
+		return err
+	}
+
+	file, err := os.Open(imageDir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checkpointer := criu.MakeCriu()
+	trackMem := true
+
+	options := dumpOptions(process, file)
+	options.TrackMem = &trackMem
+	if parent != "" {
+		options.ParentImg = &parent
+	}
+
+	return checkpointer.PreDump(options, cancelNotifier{migration: migration})
+}
+
+// pagesSize sums the page images CRIU wrote to imageDir
+func pagesSize(imageDir string) (int64, error) {
+	entries, err := ioutil.ReadDir(imageDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "pages-") {
+			size += entry.Size()
+		}
+	}
+
+	return size, nil
+}
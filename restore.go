@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/checkpoint-restore/go-criu"
+	"github.com/checkpoint-restore/go-criu/rpc"
+	"github.com/mholt/archiver"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// restoreNotifier records the PID of the restored process, which may differ
+// from the PID the process had on the source node
+type restoreNotifier struct {
+	criu.NoNotify
+	restoredPid *int32
+}
+
+func (r restoreNotifier) PostRestore(pid int32) error {
+	*r.restoredPid = pid
+	return nil
+}
+
+// incomingMigration records what the destination has built for a migration,
+// so that it can be torn down if the source rolls the migration back. Nothing
+// here is shared with another migration, or with our own processes, until
+// the restored process is registered.
+type incomingMigration struct {
+	migrationID string            // the source's ID for the migration
+	source      string            // host the migration came from
+	process     Process           // as it was on the source
+	clock       *MigrationClock   // advanced by shadowed frames
+	addrs       []string          // addresses the process had on the source
+	vif         *VirtualInterface // nil until the namespace exists
+	restoredPid int32             // zero until the process is restored
+	aborted     bool              // set once torn down, so a late restore refuses
+	restoring   sync.Mutex        // held by doRestore, so an abort waits for it
+	m           sync.Mutex
+}
+
+var (
+	// maps the source's migration ID to the *incomingMigration for it
+	IncomingMigrations *sync.Map = new(sync.Map)
+)
+
+// loadIncoming finds the migration the source calls id
+func loadIncoming(id string) (*incomingMigration, error) {
+	iincoming, ok := IncomingMigrations.Load(id)
+	if !ok {
+		return nil, errNoMigration
+	}
+
+	incoming, ok := iincoming.(*incomingMigration)
+	if !ok {
+		return nil, errors.New("migration not associated with *incomingMigration")
+	}
+
+	return incoming, nil
+}
+
+// doRestore unpacks the images received for migration id, builds a fresh
+// network namespace for the process, and restores it into that namespace.
+// For post-copy migrations pageServer is the source's lazy page server. Only
+// shadowed frames stamped after frozenAt are injected into the restored
+// process.
+func doRestore(id, images, pageServer string, frozenAt uint64) error {
+	incoming, err := loadIncoming(id)
+	if err != nil {
+		return err
+	}
+	log := incomingLog(id)
+
+	incoming.restoring.Lock()
+	defer incoming.restoring.Unlock()
+
+	incoming.m.Lock()
+	aborted := incoming.aborted
+	incoming.m.Unlock()
+
+	if aborted {
+		return fmt.Errorf("doRestore(): %s was aborted", id)
+	}
+
+	// step 1: unpack the images
+	imageDir, err := unpackCheckpoint(id, images)
+	if err != nil {
+		return err
+	}
+
+	// step 2: rebuild the network namespace, with the addresses it had
+	incoming.m.Lock()
+	process := incoming.process
+	addrs := incoming.addrs
+	incoming.m.Unlock()
+
+	handle, vif, err := setupNetNs(log, migrationOwner(process.Pid, id), addrs)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	incoming.m.Lock()
+	incoming.vif = &vif
+	incoming.m.Unlock()
+
+	// criu is exec'd by go-criu, so the namespace must survive the exec for
+	// --inherit-fd to find it
+	if err := clearCloseOnExec(int(handle)); err != nil {
+		return err
+	}
+
+	// step 3: restore the process
+	file, err := os.Open(imageDir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	restorer := criu.MakeCriu()
+	restoreSibling := true
+	fd := int32(file.Fd())
+	nsKey := "extRootNetNS"
+	nsFd := int32(handle)
+
+	options := rpc.CriuOpts{
+		RstSibling:  &restoreSibling,
+		ImagesDirFd: &fd,
+		InheritFd:   []*rpc.InheritFd{{Key: &nsKey, Fd: &nsFd}},
+	}
+	nodeConfig.CRIU.apply(&options)
+
+	if pageServer != "" {
+		lazyPages := true
+		options.LazyPages = &lazyPages
+
+		if err := startLazyPages(imageDir, pageServer); err != nil {
+			return err
+		}
+	}
+
+	var restoredPid int32
+	if err := restorer.Restore(options, restoreNotifier{restoredPid: &restoredPid}); err != nil {
+		return err
+	}
+
+	incoming.m.Lock()
+	incoming.restoredPid = restoredPid
+	incoming.m.Unlock()
+
+	// ipam.go
+	addressPool.assign(restoredPid, vif.Addrs...)
+
+	// the process is ours from here on, under whatever PID it was given
+	process.Pid = restoredPid
+	Processes.Store(process.Pid, process)
+	saveState()
+
+	log.WithField("restored_pid", process.Pid).Info("restored process")
+
+	// step 4: tell the network where the addresses went (neighbor.go)
+	if err := announceMove(log, handle, vif); err != nil {
+		log.WithError(err).Warn("unable to announce addresses")
+	}
+
+	// step 5: start accepting shadowed traffic for the new namespace
+	injector, err := newFrameInjector(vif)
+	if err != nil {
+		return err
+	}
+
+	ibuffer, ok := ShadowBuffers.Load(id)
+	if !ok {
+		injector.close()
+		return fmt.Errorf("doRestore(): no shadow buffer for %s", id)
+	}
+
+	buffer, ok := ibuffer.(*shadowBuffer)
+	if !ok {
+		injector.close()
+		return errors.New("doRestore(): process not associated with *shadowBuffer")
+	}
+	buffer.attach(injector, frozenAt)
+
+	return nil
+}
+
+// migrationOwner names an incoming migration of pid as the owner of the
+// addresses it claims (ipam.go)
+func migrationOwner(pid int32, id string) string {
+	return fmt.Sprintf("pid:%d@%s", pid, id)
+}
+
+// restoreDir is where the destination unpacks every image set it receives
+// for migration id, so that incremental dumps can find their parents
+func restoreDir(id string) string {
+	return filepath.Join(nodeConfig.ImageDir, "restore-"+id)
+}
+
+// checkpointArchive is where the destination stores an uploaded image set
+func checkpointArchive(id, images string) string {
+	return filepath.Join(nodeConfig.ImageDir, fmt.Sprintf("%s-%s.tar.gz", id, images))
+}
+
+// removeCheckpoints deletes every archive and image set received for
+// migration id
+func removeCheckpoints(id string) error {
+	archives, err := filepath.Glob(checkpointArchive(id, "*"))
+	if err != nil {
+		return err
+	}
+
+	for _, archive := range archives {
+		if err := os.Remove(archive); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(restoreDir(id))
+}
+
+// unpackCheckpoint extracts the archive of images received for migration id
+// and returns the directory holding the CRIU images
+func unpackCheckpoint(id, images string) (string, error) {
+	// a page server may already have written this image set's pages, so the
+	// archive is unpacked alongside them
+	imageDir := filepath.Join(restoreDir(id), images)
+
+	decompressor := archiver.NewTarGz()
+	if err := decompressor.Unarchive(checkpointArchive(id, images), restoreDir(id)); err != nil {
+		return "", err
+	}
+
+	// the source archives its image directory, so it unpacks under its own name
+	info, err := os.Stat(imageDir)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsDir() {
+		return "", errors.New("unpackCheckpoint(): unexpected archive layout")
+	}
+
+	return imageDir, nil
+}
+
+// startPageServer launches a CRIU page server that writes the pages of the
+// image set images straight into the restore directory for migration id, and
+// returns the port it listens on
+func startPageServer(id, images string) (int32, error) {
+	imageDir := filepath.Join(restoreDir(id), images)
+	if err := os.MkdirAll(imageDir, 0666); err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(imageDir)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	server := criu.MakeCriu()
+	fd := int32(file.Fd())
+	port := int32(0) // let criu pick a free port
+
+	options := rpc.CriuOpts{
+		ImagesDirFd: &fd,
+		Ps:          &rpc.CriuPageServerInfo{Port: &port},
+	}
+
+	// the page server exits once the source's dump disconnects
+	_, actualPort, err := server.StartPageServerChld(options)
+	if err != nil {
+		return 0, err
+	}
+
+	return int32(actualPort), nil
+}
+
+func clearCloseOnExec(fd int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
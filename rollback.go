@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/shirou/gopsutil/process"
+	"github.com/vishvananda/netlink"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// rollbackMigration undoes a migration of p that failed because of cause:
+// the destination discards what it built, the source forgets the migration so
+// it can be retried, and p is left running here. If p is already gone, as it
+// is once a post-copy dump completes, the destination may hold the only copy,
+// so it is left alone.
+func rollbackMigration(migration *Migration, p Process, destination string, cause error) {
+	migration.fail(cause)
+
+	var notes []string
+	exists, _ := process.PidExists(p.Pid)
+	if !exists {
+		notes = append(notes, "source process is gone; destination left as is")
+	} else if err := requestAbort(destination, migration.ID()); err != nil {
+		notes = append(notes, "destination not cleaned up: "+err.Error())
+	} else {
+		notes = append(notes, "destination cleaned up")
+	}
+
+	MigrationClocks.Delete(p.Pid)
+	saveState()
+
+	// CRIU resumes the process when a dump fails, but make sure nothing left
+	// it stopped
+	if exists {
+		syscall.Kill(int(p.Pid), syscall.SIGCONT)
+		notes = append(notes, "source process still running")
+	}
+
+	migration.setRollback(strings.Join(notes, "; "))
+	migration.log().WithField("rollback", strings.Join(notes, "; ")).Warn("migration rolled back")
+}
+
+// requestAbort tells destination to tear down its state for migration id
+func requestAbort(destination, id string) error {
+	res, err := peerClient.Post(peerURL(destination, "/AbortMigration?migration="+url.QueryEscape(id)),
+		"application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return responseError(res)
+}
+
+// abortIncomingMigration discards everything the destination built for
+// migration id: buffered frames, uploads, images, the restored process if
+// there is one, and its namespace. A migration we never accepted left nothing
+// to discard. A restore in progress is allowed to finish first, so that the
+// process it restores is killed rather than left behind.
+func abortIncomingMigration(id string) error {
+	incoming, err := loadIncoming(id)
+	if err != nil {
+		incomingLog(id).Debug("nothing to abort")
+		return nil
+	}
+
+	incoming.restoring.Lock()
+	defer incoming.restoring.Unlock()
+
+	if ibuffer, ok := ShadowBuffers.Load(id); ok {
+		if buffer, ok := ibuffer.(*shadowBuffer); ok {
+			buffer.close()
+		}
+		ShadowBuffers.Delete(id)
+	}
+
+	incoming.m.Lock()
+	incoming.aborted = true
+	if incoming.restoredPid != 0 {
+		syscall.Kill(int(incoming.restoredPid), syscall.SIGKILL)
+		Processes.Delete(incoming.restoredPid)
+	}
+
+	// deleting either end of a veth pair deletes both
+	if incoming.vif != nil {
+		if link, err := netlink.LinkByName(incoming.vif.PeerName); err == nil {
+			netlink.LinkDel(link)
+		}
+		Namespaces.Delete(incoming.vif.PeerName)
+		inventory.forget(ResourceLink, incoming.vif.PeerName)
+		addressPool.release(incoming.vif.Addrs...)
+	}
+	incoming.m.Unlock()
+
+	// ipam.go; addresses claimed for a namespace that was never built
+	addressPool.releaseClaims(migrationOwner(incoming.process.Pid, id))
+
+	IncomingMigrations.Delete(id)
+	saveState()
+
+	prefix := filepath.Join(nodeConfig.ImageDir, id+"-")
+	CheckpointUploads.Range(func(key, value interface{}) bool {
+		if path, ok := key.(string); ok && strings.HasPrefix(path, prefix) {
+			CheckpointUploads.Delete(key)
+		}
+		return true
+	})
+
+	// restore.go
+	return removeCheckpoints(id)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a restored process waits on a missing frame before skipping it
+	ShadowGapTimeout = 500 * time.Millisecond
+)
+
+// frameInjector writes shadowed frames into a restored process's namespace
+type frameInjector struct {
+	handle  *pcap.Handle
+	vif     VirtualInterface
+	gateway net.HardwareAddr // MAC of the bridge, which eth0 routes through
+	ip4     net.IP           // eth0's addresses; nil for a family it lacks
+	ip6     net.IP
+	m       sync.Mutex
+}
+
+// frameSink is where a shadowBuffer releases its frames; a *frameInjector
+// outside of tests
+type frameSink interface {
+	inject(frame []byte) error
+	close()
+}
+
+// shadowBuffer holds the frames shadowed for one migration until the process
+// is restored, and releases them in the order the source captured them
+type shadowBuffer struct {
+	id       string                 // the migration the frames belong to
+	pending  []ShadowTrafficMessage // sorted by Clock.SourceTime
+	next     uint64                 // SourceTime of the next frame to inject
+	injector frameSink              // nil until the process is restored
+	gapTimer *time.Timer            // running while the frame at next is missing
+	m        sync.Mutex
+}
+
+var (
+	// maps a migration ID to the *shadowBuffer for it
+	ShadowBuffers *sync.Map = new(sync.Map)
+)
+
+// newShadowBuffer creates a buffer for a migration that the source announced
+// at clock; the first shadowed frame is stamped one tick later
+func newShadowBuffer(id string, clock MigrationClock) *shadowBuffer {
+	return &shadowBuffer{id: id, next: clock.SourceTime + 1}
+}
+
+// push buffers msg, dropping duplicates and frames we have already injected
+func (b *shadowBuffer) push(msg ShadowTrafficMessage) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	t := msg.Clock.SourceTime
+	if t < b.next {
+		return
+	}
+
+	i := sort.Search(len(b.pending), func(i int) bool {
+		return b.pending[i].Clock.SourceTime >= t
+	})
+	if i < len(b.pending) && b.pending[i].Clock.SourceTime == t {
+		return
+	}
+
+	b.pending = append(b.pending, ShadowTrafficMessage{})
+	copy(b.pending[i+1:], b.pending[i:])
+	b.pending[i] = msg
+
+	b.drain()
+}
+
+// attach hands the buffer the injector for the restored process and flushes
+// everything received while the process was down. Frames stamped at or before
+// frozenAt reached the original before its final dump froze it, so the
+// restored copy has them already.
+func (b *shadowBuffer) attach(injector frameSink, frozenAt uint64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if frozenAt >= b.next {
+		i := sort.Search(len(b.pending), func(i int) bool {
+			return b.pending[i].Clock.SourceTime > frozenAt
+		})
+		b.pending = b.pending[i:]
+		b.next = frozenAt + 1
+	}
+
+	b.injector = injector
+	b.drain()
+}
+
+// drain injects frames for as long as they are contiguous. b.m must be held.
+func (b *shadowBuffer) drain() {
+	if b.injector == nil {
+		return
+	}
+
+	advanced := false
+	for len(b.pending) > 0 && b.pending[0].Clock.SourceTime == b.next {
+		if err := b.injector.inject(b.pending[0].Frame); err != nil {
+			incomingLog(b.id).WithError(err).Warn("unable to inject frame")
+		}
+
+		b.pending = b.pending[1:]
+		b.next += 1
+		advanced = true
+	}
+
+	// the source does not retry failed forwards, so a gap may never fill.
+	// Each gap gets the full timeout from when it reached the front.
+	if b.gapTimer != nil && (advanced || len(b.pending) == 0) {
+		b.gapTimer.Stop()
+		b.gapTimer = nil
+	}
+
+	if len(b.pending) > 0 && b.gapTimer == nil {
+		gap := b.next
+		b.gapTimer = time.AfterFunc(ShadowGapTimeout, func() { b.skipGap(gap) })
+	}
+}
+
+// flush injects every buffered frame in order without waiting for gaps to
+// fill, for when no more frames will arrive
+func (b *shadowBuffer) flush() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.injector == nil {
+		return
+	}
+
+	for len(b.pending) > 0 {
+		b.next = b.pending[0].Clock.SourceTime
+		b.drain()
+	}
+}
+
+// close discards any buffered frames and releases the injector
+func (b *shadowBuffer) close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.gapTimer != nil {
+		b.gapTimer.Stop()
+		b.gapTimer = nil
+	}
+
+	if b.injector != nil {
+		b.injector.close()
+		b.injector = nil
+	}
+
+	b.pending = nil
+}
+
+// skipGap gives up on the frames missing from gap onwards. A timer that fired
+// as its gap was filled finds next has moved on, and leaves the new gap's
+// timer alone.
+func (b *shadowBuffer) skipGap(gap uint64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if gap != b.next {
+		return
+	}
+
+	b.gapTimer = nil
+	if len(b.pending) == 0 || b.pending[0].Clock.SourceTime == b.next {
+		return
+	}
+
+	incomingLog(b.id).WithFields(logrus.Fields{
+		"first": b.next,
+		"last":  b.pending[0].Clock.SourceTime - 1,
+	}).Warn("lost shadowed frames")
+	b.next = b.pending[0].Clock.SourceTime
+	b.drain()
+}
+
+func newFrameInjector(vif VirtualInterface) (*frameInjector, error) {
+	bridge, err := netlink.LinkByName(nodeConfig.Bridge)
+	if err != nil {
+		return nil, err
+	}
+
+	var ip4, ip6 net.IP
+	for _, addr := range vif.Addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, errors.New("newFrameInjector(): cannot parse namespace IP")
+		}
+
+		if v4 := ip.To4(); v4 != nil {
+			ip4 = v4
+		} else {
+			ip6 = ip
+		}
+	}
+
+	// frames written to the bridge-side peer come out of eth0 in the namespace
+	handle, err := pcap.OpenLive(vif.PeerName, 1600, false, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+
+	return &frameInjector{
+		handle:  handle,
+		vif:     vif,
+		gateway: bridge.Attrs().HardwareAddr,
+		ip4:     ip4,
+		ip6:     ip6,
+	}, nil
+}
+
+// inject rewrites a frame captured on the source so that it is addressed to
+// the restored process, then writes it into the namespace
+func (f *frameInjector) inject(frame []byte) error {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+
+	eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return errors.New("inject(): frame is not ethernet")
+	}
+	eth.SrcMAC = f.gateway
+	eth.DstMAC = f.vif.HardwareAddr
+
+	// the source captured traffic bound for its public address
+	if ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok && f.ip4 != nil {
+		ip.DstIP = f.ip4
+
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			tcp.SetNetworkLayerForChecksum(ip)
+		}
+
+		if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(ip)
+		}
+	}
+
+	if ip, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok && f.ip6 != nil {
+		ip.DstIP = f.ip6
+
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			tcp.SetNetworkLayerForChecksum(ip)
+		}
+
+		if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(ip)
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializePacket(buffer, options, packet); err != nil {
+		return err
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	return f.handle.WritePacketData(buffer.Bytes())
+}
+
+func (f *frameInjector) close() {
+	f.handle.Close()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink remembers the SourceTime each injected frame was stamped with
+type recordingSink struct {
+	injected []uint64
+	closed   bool
+	m        sync.Mutex
+}
+
+func (s *recordingSink) inject(frame []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.injected = append(s.injected, uint64(frame[0]))
+	return nil
+}
+
+func (s *recordingSink) close() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.closed = true
+}
+
+func (s *recordingSink) frames() []uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return append([]uint64{}, s.injected...)
+}
+
+// shadowFrame is a message whose frame is just its own SourceTime
+func shadowFrame(t uint64) ShadowTrafficMessage {
+	return ShadowTrafficMessage{Clock: MigrationClock{SourceTime: t}, Frame: []byte{byte(t)}}
+}
+
+func TestShadowBufferOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []uint64 // pushed before the process is restored
+		after  []uint64 // pushed once it is
+		want   []uint64
+	}{
+		{"in order", []uint64{1, 2}, []uint64{3, 4}, []uint64{1, 2, 3, 4}},
+		{"reversed while down", []uint64{3, 2, 1}, nil, []uint64{1, 2, 3}},
+		{"reversed once restored", nil, []uint64{4, 3, 2, 1}, []uint64{1, 2, 3, 4}},
+		{"interleaved", []uint64{2, 4}, []uint64{3, 1}, []uint64{1, 2, 3, 4}},
+		{"duplicates while down", []uint64{1, 1, 2, 2}, nil, []uint64{1, 2}},
+		{"duplicates of injected frames", []uint64{1, 2}, []uint64{1, 2, 3, 3}, []uint64{1, 2, 3}},
+		{"older than the announcement", []uint64{0}, []uint64{1}, []uint64{1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := newShadowBuffer("test", MigrationClock{})
+			sink := &recordingSink{}
+			defer buffer.close()
+
+			for _, ts := range test.before {
+				buffer.push(shadowFrame(ts))
+			}
+			buffer.attach(sink, 0)
+			for _, ts := range test.after {
+				buffer.push(shadowFrame(ts))
+			}
+
+			if got := sink.frames(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("injected %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestShadowBufferDropsFramesBeforeFreeze(t *testing.T) {
+	tests := []struct {
+		name     string
+		frozenAt uint64
+		before   []uint64 // pushed before the process is restored
+		after    []uint64 // pushed once it is
+		want     []uint64
+	}{
+		{"frozen before any frame", 0, []uint64{1, 2}, []uint64{3}, []uint64{1, 2, 3}},
+		{"frozen partway", 2, []uint64{1, 2, 3, 4}, []uint64{5}, []uint64{3, 4, 5}},
+		{"late frames from before the freeze", 2, []uint64{3}, []uint64{1, 2, 4}, []uint64{3, 4}},
+		{"frozen past every buffered frame", 4, []uint64{1, 2}, []uint64{4, 5}, []uint64{5}},
+		{"missing frames from before the freeze", 3, []uint64{4, 5}, nil, []uint64{4, 5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := newShadowBuffer("test", MigrationClock{})
+			sink := &recordingSink{}
+			defer buffer.close()
+
+			for _, ts := range test.before {
+				buffer.push(shadowFrame(ts))
+			}
+			buffer.attach(sink, test.frozenAt)
+			for _, ts := range test.after {
+				buffer.push(shadowFrame(ts))
+			}
+
+			if got := sink.frames(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("injected %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestShadowBufferSkipsGap(t *testing.T) {
+	buffer := newShadowBuffer("test", MigrationClock{})
+	sink := &recordingSink{}
+	buffer.attach(sink, 0)
+	defer buffer.close()
+
+	buffer.push(shadowFrame(1))
+	buffer.push(shadowFrame(3))
+
+	if got := sink.frames(); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Fatalf("injected %v across a gap", got)
+	}
+
+	time.Sleep(ShadowGapTimeout + ShadowGapTimeout/2)
+	if got := sink.frames(); !reflect.DeepEqual(got, []uint64{1, 3}) {
+		t.Fatalf("injected %v after the gap timed out, want [1 3]", got)
+	}
+
+	// the missing frame is too late once skipped
+	buffer.push(shadowFrame(2))
+	if got := sink.frames(); !reflect.DeepEqual(got, []uint64{1, 3}) {
+		t.Errorf("injected %v, want the skipped frame dropped", got)
+	}
+}
+
+func TestShadowBufferRearmsForLaterGap(t *testing.T) {
+	buffer := newShadowBuffer("test", MigrationClock{})
+	sink := &recordingSink{}
+	buffer.attach(sink, 0)
+	defer buffer.close()
+
+	// 2 and 4 are missing
+	buffer.push(shadowFrame(1))
+	buffer.push(shadowFrame(3))
+	buffer.push(shadowFrame(5))
+
+	// 2 turns up most of the way through its timeout, leaving 4 at the front
+	time.Sleep(ShadowGapTimeout * 4 / 5)
+	buffer.push(shadowFrame(2))
+	if got := sink.frames(); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Fatalf("injected %v, want [1 2 3]", got)
+	}
+
+	// past the first gap's deadline, but not the second's
+	time.Sleep(ShadowGapTimeout * 2 / 5)
+	if got := sink.frames(); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Fatalf("injected %v before the second gap timed out", got)
+	}
+
+	time.Sleep(ShadowGapTimeout)
+	if got := sink.frames(); !reflect.DeepEqual(got, []uint64{1, 2, 3, 5}) {
+		t.Errorf("injected %v, want [1 2 3 5]", got)
+	}
+}
+
+func TestShadowBufferFlush(t *testing.T) {
+	buffer := newShadowBuffer("test", MigrationClock{})
+	sink := &recordingSink{}
+	buffer.attach(sink, 0)
+
+	buffer.push(shadowFrame(4))
+	buffer.push(shadowFrame(2))
+	buffer.flush()
+
+	if got := sink.frames(); !reflect.DeepEqual(got, []uint64{2, 4}) {
+		t.Errorf("flushed %v, want [2 4]", got)
+	}
+
+	buffer.close()
+	if !sink.closed {
+		t.Error("close left the injector open")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/shirou/gopsutil/process"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// NodeState is what a node journals to disk so that a restarted daemon
+// remembers its processes and never hands out an address that is in use
+type NodeState struct {
+	NetworkCIDR string                   // the leases below belong to this block
+	Processes   []Process                // registered processes
+	Clocks      map[int32]MigrationClock // migrations in flight, by PID
+	Leases      []Lease
+	VethCount   uint64
+	Namespaces  []VirtualInterface // namespaces we built, by their bridge-side link
+}
+
+var (
+	// maps the bridge-side link name of each namespace we built to its
+	// VirtualInterface
+	Namespaces *sync.Map = new(sync.Map)
+
+	stateMutex sync.Mutex
+)
+
+// saveState journals the node's state to the configured state file. The file
+// is replaced atomically, so a crash leaves either the old or the new state.
+func saveState() {
+	path := nodeConfig.StateFile
+	if path == "" {
+		return
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	vethMutex.Lock()
+	state := NodeState{
+		NetworkCIDR: netCidr,
+		Clocks:      map[int32]MigrationClock{},
+		VethCount:   vethCount,
+	}
+	vethMutex.Unlock()
+
+	if addressPool != nil {
+		state.Leases = addressPool.list()
+	}
+
+	Processes.Range(func(key, value interface{}) bool {
+		if p, ok := value.(Process); ok {
+			state.Processes = append(state.Processes, p)
+		}
+		return true
+	})
+
+	MigrationClocks.Range(func(key, value interface{}) bool {
+		pid, ok := key.(int32)
+		clock, isClock := value.(*MigrationClock)
+		if ok && isClock {
+			state.Clocks[pid] = *clock
+		}
+		return true
+	})
+
+	Namespaces.Range(func(key, value interface{}) bool {
+		if vif, ok := value.(VirtualInterface); ok {
+			state.Namespaces = append(state.Namespaces, vif)
+		}
+		return true
+	})
+
+	jsonBytes, err := json.Marshal(state)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal node state")
+		return
+	}
+
+	if err := writeFileAtomic(path, jsonBytes); err != nil {
+		logger.WithError(err).WithField("path", path).Error("unable to save node state")
+	}
+}
+
+// writeFileAtomic replaces path with contents, so a crash leaves either the
+// old or the new file
+func writeFileAtomic(path string, contents []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(contents)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// loadState reloads the journaled state and reconciles it with what is
+// actually running. It must follow verifyBridgePresence, which creates the
+// pool.
+func loadState() error {
+	path := nodeConfig.StateFile
+	if path == "" {
+		return nil
+	}
+
+	jsonBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return reconcileLinks(map[string]VirtualInterface{}, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	var state NodeState
+	if err := json.Unmarshal(jsonBytes, &state); err != nil {
+		return err
+	}
+
+	log := logger.WithField("path", path)
+
+	// a process that exited while we were down is gone for good
+	for _, p := range state.Processes {
+		if exists, _ := process.PidExists(p.Pid); !exists {
+			log.WithField("pid", p.Pid).Info("forgetting process that exited")
+			continue
+		}
+		Processes.Store(p.Pid, p)
+	}
+
+	// the migrations themselves died with the daemon. Processes they froze
+	// are resumed so that they can be migrated again.
+	for pid := range state.Clocks {
+		if _, ok := Processes.Load(pid); ok {
+			syscall.Kill(int(pid), syscall.SIGCONT)
+		}
+		log.WithField("pid", pid).Warn("migration interrupted by restart")
+	}
+
+	if state.VethCount > vethCount {
+		vethCount = state.VethCount
+	}
+
+	namespaces := map[string]VirtualInterface{}
+	for _, vif := range state.Namespaces {
+		namespaces[vif.PeerName] = vif
+	}
+
+	// leases are only carried over for the network they were drawn from
+	var leases []Lease
+	if state.NetworkCIDR == netCidr {
+		leases = state.Leases
+	}
+
+	if err := reconcileLinks(namespaces, leases); err != nil {
+		return err
+	}
+
+	saveState()
+	return nil
+}
+
+// reconcileLinks compares the namespaces and leases we remember with the veth
+// links that exist. A namespace's bridge-side link disappears with it, so a
+// lease is only kept while its link exists. Links left in the root namespace
+// by a half-finished setupNetNs are removed.
+func reconcileLinks(namespaces map[string]VirtualInterface, leases []Lease) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	live := map[string]bool{}
+	var unfinished []netlink.Link
+	for _, link := range links {
+		name := link.Attrs().Name
+
+		var index string
+		switch {
+		case strings.HasPrefix(name, "brveth"):
+			index = strings.TrimPrefix(name, "brveth")
+			live[name] = true
+		case strings.HasPrefix(name, "hveth"):
+			index = strings.TrimPrefix(name, "hveth")
+		default:
+			continue
+		}
+
+		// never reuse the name of a link that exists
+		if n, err := strconv.ParseUint(index, 10, 64); err == nil && n >= vethCount {
+			vethCount = n + 1
+		}
+
+		// hveth ends are moved into their namespace, so one still here was
+		// never finished
+		if strings.HasPrefix(name, "hveth") {
+			unfinished = append(unfinished, link)
+		}
+	}
+
+	// deleting either end of a veth pair deletes both
+	for _, link := range unfinished {
+		name := link.Attrs().Name
+		logger.WithField("link", name).Warn("removing unfinished veth pair")
+		if err := netlink.LinkDel(link); err != nil {
+			return err
+		}
+		delete(live, "br"+strings.TrimPrefix(name, "h"))
+
+		// inventory.go
+		inventory.forget(ResourceLink, "br"+strings.TrimPrefix(name, "h"))
+	}
+
+	for name, vif := range namespaces {
+		if !live[name] {
+			logger.WithFields(logrus.Fields{"link": name, "addrs": vif.Addrs}).
+				Info("namespace is gone")
+			continue
+		}
+
+		Namespaces.Store(name, vif)
+	}
+
+	unrecorded, err := restoreLeases(live, leases)
+	if err != nil {
+		return err
+	}
+
+	// we can't learn what an unrecorded namespace was given, so all we can
+	// do is avoid its name
+	for _, name := range unrecorded {
+		logger.WithField("link", name).Warn("found veth link we have no record of")
+	}
+
+	return nil
+}
+
+// restoreLeases puts back the leases whose link is live, and returns the live
+// links that no lease is on. A dual-stack namespace holds a lease per family
+// on the same link.
+func restoreLeases(live map[string]bool, leases []Lease) ([]string, error) {
+	leased := map[string]bool{}
+	for _, lease := range leases {
+		if !live[lease.Link] {
+			logger.WithFields(logrus.Fields{"link": lease.Link, "addr": lease.Addr}).
+				Info("releasing address of namespace that is gone")
+			continue
+		}
+
+		// ipam.go
+		if err := addressPool.restore(lease); err != nil {
+			return nil, err
+		}
+		leased[lease.Link] = true
+	}
+
+	var unrecorded []string
+	for name := range live {
+		if !leased[name] {
+			unrecorded = append(unrecorded, name)
+		}
+	}
+	sort.Strings(unrecorded)
+
+	return unrecorded, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRestoreLeases(t *testing.T) {
+	pool := mustIPAM(t, "10.0.0.0/24,fd00::/64", nil, nil, nil)
+	saved := addressPool
+	addressPool = pool
+	defer func() { addressPool = saved }()
+
+	live := map[string]bool{"brveth1": true, "brveth2": true, "brveth3": true}
+	leases := []Lease{
+		// a dual-stack namespace
+		{Addr: "10.0.0.1", Owner: "a", Link: "brveth1"},
+		{Addr: "fd00::1", Owner: "a", Link: "brveth1"},
+		// a single-stack one
+		{Addr: "10.0.0.2", Owner: "b", Link: "brveth2"},
+		// a namespace that went away with the daemon
+		{Addr: "10.0.0.4", Owner: "d", Link: "brveth4"},
+		{Addr: "fd00::4", Owner: "d", Link: "brveth4"},
+	}
+
+	unrecorded, err := restoreLeases(live, leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"brveth3"}; !reflect.DeepEqual(unrecorded, want) {
+		t.Errorf("unrecorded links are %v, want %v", unrecorded, want)
+	}
+
+	var restored []string
+	for _, lease := range pool.list() {
+		restored = append(restored, lease.Addr)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2", "fd00::1"}; !reflect.DeepEqual(restored, want) {
+		t.Errorf("restored %v, want %v", restored, want)
+	}
+
+	// neither of the dual-stack namespace's addresses is handed out again
+	for _, owner := range []string{"x", "y"} {
+		addrs, err := pool.allocate(owner, "brveth-"+owner, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range addrs {
+			if addr == "10.0.0.1" || addr == "fd00::1" || addr == "10.0.0.2" {
+				t.Errorf("%s handed out again to %s", addr, owner)
+			}
+		}
+	}
+}
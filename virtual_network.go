@@ -8,27 +8,42 @@ import (
 	"github.com/vishvananda/netns"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/docker/docker/pkg/mount"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"net"
 	"os/exec"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-const (
-	BridgeName = "handoff-bridge"
-)
+// VirtualInterface describes the veth pair connecting a namespace to the bridge
+type VirtualInterface struct {
+	PeerName     string           // bridge-side end of the veth pair
+	HardwareAddr net.HardwareAddr // MAC of eth0 inside the namespace
+	Addrs        []string         // IPs assigned to eth0, one per address family
+}
 
 var (
 	vethCount uint64 = 1
-	freeIPs   []string
-	bridgeAddr string
+	vethMutex  sync.Mutex
+	bridgeAddrs []*netlink.Addr // the bridge's address in each block of netCidr
 	netCidr string
 )
 
 func verifyBridgePresence(bridgeCidr string) error {
-	if err := setupIPTables(bridgeCidr); err != nil {
+	// ipam.go; an IPv4 block, an IPv6 block, or one of each
+	cidrs, err := splitNetworks(bridgeCidr)
+	if err != nil {
+		return err
+	}
+
+	if err := setupIPTables(cidrs); err != nil {
 		return err
 	}
 
@@ -37,41 +52,70 @@ func verifyBridgePresence(bridgeCidr string) error {
 		return err
 	}
 
-	// parse the CIDR block supplied by user
-	addr, err := netlink.ParseAddr(bridgeCidr)
+	// parse the CIDR blocks supplied by user
+	var addrs []*netlink.Addr
+	var exclude []string
+	for _, cidr := range cidrs {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+
+		// the bridge is every namespace's gateway, so it keeps its addresses
+		exclude = append(exclude, addr.IP.String())
+	}
+	exclude = append(exclude, nodeConfig.IPAM.Exclude...)
+
+	addressPool, err = newIPAM(bridgeCidr, exclude, nodeConfig.IPAM.AllocateFrom, nodeConfig.IPAM.Reservations)
 	if err != nil {
 		return err
 	}
-	freeIPs, _ = hosts(bridgeCidr)
 
 	netCidr = bridgeCidr
 
-	link, err := handle.LinkByName(BridgeName)
+	created := false
+	link, err := handle.LinkByName(nodeConfig.Bridge)
 	if err != nil {
 		// we need to create the link
 		linkAttrs := netlink.NewLinkAttrs()
-		linkAttrs.Name = BridgeName
+		linkAttrs.Name = nodeConfig.Bridge
 
 		link = &netlink.Bridge{LinkAttrs: linkAttrs}
 		if err := netlink.LinkAdd(link); err != nil {
 			return err
 		}
+		logger.WithField("bridge", nodeConfig.Bridge).Info("created bridge")
+
+		// inventory.go; its addresses go with it
+		inventory.record(Resource{Kind: ResourceLink, Name: nodeConfig.Bridge})
+		created = true
 	}
 
 	// at this point, the bridge ought to exist
 	// we need to `up` it!
 	netlink.LinkSetUp(link)
 
-	// ...and add its address (ignore return code for now, since it's not idempotent)
-	netlink.AddrAdd(link, addr)
+	// ...and add its addresses (ignore return code for now, since it's not idempotent)
+	for _, addr := range addrs {
+		if err := netlink.AddrAdd(link, addr); err == nil && !created {
+			inventory.record(Resource{Kind: ResourceAddr, Name: nodeConfig.Bridge, Addr: addr.IPNet.String()})
+		}
+	}
+
+	bridgeAddrs = addrs
 
-	bridgeAddr = addr.IP.String()
+	logger.WithFields(logrus.Fields{
+		"bridge": nodeConfig.Bridge,
+		"addrs":  cidrs,
+		"free":   addressPool.status().Free,
+	}).Debug("bridge ready")
 
 	return nil
 }
 
 func execInNetNS(command string, args []string) error {
-	// bridge, err := netlink.LinkByName(BridgeName)
+	// bridge, err := netlink.LinkByName(nodeConfig.Bridge)
 	// if err != nil {
 	// 	return err
 	// }
@@ -191,7 +235,9 @@ func execInNetNS(command string, args []string) error {
 	// 	return err
 	// }
 
-	newns, err := setupNetNs()
+	log := logger.WithField("command", command)
+
+	newns, vif, err := setupNetNs(log, command, nil)
 	if err != nil {
 		return err
 	}
@@ -224,7 +270,20 @@ func execInNetNS(command string, args []string) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
 	// cmdErr := cmd.Start()
-	cmd.Start()	
+	if err := cmd.Start(); err != nil {
+		log.WithError(err).Error("unable to start command")
+	} else {
+		// ipam.go; the addresses go wherever the process migrates to
+		addressPool.assign(int32(cmd.Process.Pid), vif.Addrs...)
+		saveState()
+
+		// inventory.go; its namespace is freed once it exits
+		inventory.record(Resource{
+			Kind:    ResourceProcess,
+			Pid:     int32(cmd.Process.Pid),
+			Command: filepath.Base(command),
+		})
+	}
 
 	// once again, restore netns
 	// if err = netns.Set(oldns); err != nil {
@@ -265,45 +324,66 @@ func execInNetNS(command string, args []string) error {
 	return nil
 }
 
-func setupNetNs() (netns.NsHandle, error) {
+// setupNetNs builds a namespace with eth0 on the bridge, addressed from the
+// pool on behalf of owner. Addresses in requested are used as they are, and
+// any other address family is allocated. log carries whatever identifies who
+// the namespace is for.
+func setupNetNs(log *logrus.Entry, owner string, requested []string) (netns.NsHandle, VirtualInterface, error) {
 	var handle netns.NsHandle
+	var vif VirtualInterface
 
-	bridge, err := netlink.LinkByName(BridgeName)
+	bridge, err := netlink.LinkByName(nodeConfig.Bridge)
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	// create a new veth interface
-	countStr := strconv.FormatUint(vethCount, 10)
+	countStr := strconv.FormatUint(nextVethIndex(), 10)
+	// the bridge's MTU is smaller than usual when it is on the overlay
+	mtu := bridge.Attrs().MTU
+	if mtu == 0 {
+		mtu = 1500
+	}
+
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: "hveth" + countStr,
-			MTU:  1500},
+			MTU:  mtu},
 		PeerName: "brveth" + countStr,
 	}
 
-	if len(freeIPs) == 0 {
-		return handle, errors.New("No more IPs left in virtual network")
+	// ipam.go; the leases are given back unless the namespace is finished
+	vethAddrs, err := addressPool.allocate(owner, veth.PeerName, requested)
+	if err != nil {
+		return handle, vif, err
 	}
+	defer func() {
+		if vif.Addrs == nil {
+			addressPool.release(vethAddrs...)
+		}
+	}()
 
 	if err = netlink.LinkAdd(veth); err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
+	// inventory.go; deleting either end of a veth pair deletes both
+	inventory.record(Resource{Kind: ResourceLink, Name: veth.PeerName})
+
 	// attach the peer to the bridge
 	peerIdx, err := netlink.VethPeerIndex(veth)
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	peer, err := netlink.LinkByIndex(peerIdx)
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	rbridge := netlink.Bridge{LinkAttrs: *(bridge.Attrs())}
 	if netlink.LinkSetMaster(peer, &rbridge) != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	// now we create a new network namespace
@@ -313,12 +393,12 @@ func setupNetNs() (netns.NsHandle, error) {
 	oldns, err := netns.Get()
 	defer oldns.Close()
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	handle, err = netns.New()
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 	defer func() {
 		// an insurance policy against an early return leaving us in the old netns
@@ -336,123 +416,181 @@ func setupNetNs() (netns.NsHandle, error) {
 	veth.PeerName = "" // prevents moving peer into namespace
 	err = netlink.LinkSetNsFd(veth, int(handle))
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	// set both ends of the veth up
 	err = netlink.LinkSetUp(peer)
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	// enter the netns
 	if err = netns.Set(handle); err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	// rename vethn to eth0
 	if err = netlink.LinkSetName(veth, "eth0"); err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	// and set it up
 	if err = netlink.LinkSetUp(veth); err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
 	// and set up lo
-	setupLoopback()
+	if err := setupLoopback(); err != nil {
+		log.WithError(err).Warn("unable to set up loopback")
+	}
 
-	// and assign it an IP
-	// TODO -- protect me!
-	vethAddr := freeIPs[0]
-	freeIPs = freeIPs[1:]
-	vethCount += 1
+	// and assign it the IPs we leased
+	for _, vethAddr := range vethAddrs {
+		addr, err := makeHostAddr(vethAddr)
+		if err != nil {
+			return handle, vif, err
+		}
+		netlink.AddrAdd(veth, addr)
+	}
 
-	addr, err := netlink.ParseAddr(vethAddr + "/32")
-	if err != nil {
-		return handle, err
+	// each address family routes through the bridge
+	for _, gateway := range bridgeAddrs {
+		bridgeRoute := makeBridgeNetRoute(veth.Attrs().Index, gateway)
+		if err = netlink.RouteAdd(&bridgeRoute); err != nil {
+			return handle, vif, err
+		}
+
+		// add the default route
+		defaultRoute := makeDefaultRoute(veth.Attrs().Index, gateway)
+		if err = netlink.RouteAdd(&defaultRoute); err != nil {
+			return handle, vif, err
+		}
 	}
-	netlink.AddrAdd(veth, addr)
 
-	bridgeRoute, err := makeBridgeNetRoute(veth.Attrs().Index)
+	// re-read eth0 so we pick up the MAC the kernel assigned it
+	eth0, err := netlink.LinkByName("eth0")
 	if err != nil {
-		return handle, err
+		return handle, vif, err
 	}
 
-	if err = netlink.RouteAdd(&bridgeRoute); err != nil {
-		return handle, err
+	vif.PeerName = peer.Attrs().Name
+	vif.HardwareAddr = eth0.Attrs().HardwareAddr
+	vif.Addrs = vethAddrs
+
+	// state.go
+	Namespaces.Store(vif.PeerName, vif)
+	saveState()
+
+	log.WithFields(logrus.Fields{"veth": vif.PeerName, "addrs": vif.Addrs}).Info("namespace ready")
+
+	return handle, vif, nil
+}
+
+// namespaceAddrs lists the global addresses on eth0 in pid's network
+// namespace. A process sharing our namespace has none of its own.
+func namespaceAddrs(pid int32) ([]string, error) {
+	ns, err := netns.GetFromPid(int(pid))
+	if err != nil {
+		return nil, err
 	}
+	defer ns.Close()
 
-	// add the default route
-	defaultRoute, err := makeDefaultRoute(veth.Attrs().Index)
+	ours, err := netns.Get()
 	if err != nil {
-		return handle, err
+		return nil, err
 	}
+	defer ours.Close()
 
-	if err = netlink.RouteAdd(&defaultRoute); err != nil {
-		return handle, err
+	if ns.Equal(ours) {
+		return nil, nil
 	}
 
-	return handle, nil
-}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Delete()
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
+	eth0, err := handle.LinkByName("eth0")
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		// not a namespace we built
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
-}
 
-func hosts(cidr string) ([]string, error) {
-	ip, ipnet, err := net.ParseCIDR(cidr)
+	addrs, err := handle.AddrList(eth0, netlink.FAMILY_ALL)
 	if err != nil {
 		return nil, err
 	}
 
-	var ips []string
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		ips = append(ips, ip.String())
+	var found []string
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			found = append(found, addr.IP.String())
+		}
 	}
 
-	return ips[1 : len(ips)-1], nil
+	return found, nil
 }
 
-func makeDefaultRoute(linkIndex int) (netlink.Route, error) {
-	route := netlink.Route{}
+// nextVethIndex reserves the number for a new veth pair's names
+func nextVethIndex() uint64 {
+	vethMutex.Lock()
+	defer vethMutex.Unlock()
 
-	_, dst, err := net.ParseCIDR("0.0.0.0/0")
-	if err != nil {
-		return route, err
-	}
+	index := vethCount
+	vethCount += 1
+	return index
+}
 
-	ip := net.ParseIP(bridgeAddr)
+// makeHostAddr addresses eth0 with addr alone. IPv6 addresses skip duplicate
+// address detection: the pool already keeps them unique, and a restored
+// process can't bind to an address that is still tentative.
+func makeHostAddr(addr string) (*netlink.Addr, error) {
+	ip := net.ParseIP(addr)
 	if ip == nil {
-		return route, errors.New("cannot parse bridge IP")
+		return nil, errors.New("cannot parse namespace IP")
 	}
 
-	route.Dst = dst
-	route.LinkIndex = linkIndex
-	route.Gw = ip
+	if ip.To4() != nil {
+		return netlink.ParseAddr(addr + "/32")
+	}
+
+	hostAddr, err := netlink.ParseAddr(addr + "/128")
+	if err != nil {
+		return nil, err
+	}
+	hostAddr.Flags = syscall.IFA_F_NODAD
 
-	return route, nil
+	return hostAddr, nil
 }
 
-func makeBridgeNetRoute(link int) (netlink.Route, error) {
-	route := netlink.Route{}
+// makeDefaultRoute routes gateway's address family through it
+func makeDefaultRoute(linkIndex int, gateway *netlink.Addr) netlink.Route {
+	bits := net.IPv6len * 8
+	if gateway.IP.To4() != nil {
+		bits = net.IPv4len * 8
+	}
 
-	_, dst, err := net.ParseCIDR(netCidr)
-	if err != nil {
-		return route, err
+	return netlink.Route{
+		Dst:       &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(0, bits)},
+		LinkIndex: linkIndex,
+		Gw:        gateway.IP,
 	}
+}
 
-	route.Dst = dst
-	route.LinkIndex = link
-	route.Scope = netlink.SCOPE_LINK
+// makeBridgeNetRoute puts the block gateway is in on the link
+func makeBridgeNetRoute(link int, gateway *netlink.Addr) netlink.Route {
+	dst := &net.IPNet{IP: gateway.IP.Mask(gateway.Mask), Mask: gateway.Mask}
 
-	return route, nil
+	return netlink.Route{
+		Dst:       dst,
+		LinkIndex: link,
+		Scope:     netlink.SCOPE_LINK,
+	}
 }
 
 func setupLoopback() error {
@@ -470,23 +608,112 @@ func setupLoopback() error {
 		return err
 	}
 
-	return netlink.LinkSetUp(lo)
-}
+	if err = netlink.LinkSetUp(lo); err != nil {
+		return err
+	}
 
-func setupIPTables(bridgeCidr string) error {
-	table, err := iptables.New()
+	// the kernel usually adds ::1 itself once lo is up, and can't if IPv6 is
+	// disabled
+	addr, err = netlink.ParseAddr("::1/128")
 	if err != nil {
 		return err
 	}
 
-	if err = table.AppendUnique("nat", "POSTROUTING", "-s", bridgeCidr, "-j", "MASQUERADE"); err != nil {
+	if err = netlink.AddrAdd(lo, addr); err != nil && err != syscall.EEXIST {
+		return err
+	}
+
+	return nil
+}
+
+// setupIPTables masquerades traffic leaving each block, using ip6tables for
+// IPv6 blocks
+func setupIPTables(bridgeCidrs []string) error {
+	for _, bridgeCidr := range bridgeCidrs {
+		protocol := iptables.ProtocolIPv4
+		if ip, _, err := net.ParseCIDR(bridgeCidr); err == nil && ip.To4() == nil {
+			protocol = iptables.ProtocolIPv6
+		}
+
+		table, err := iptables.NewWithProtocol(protocol)
+		if err != nil {
+			return err
+		}
+
+		// traffic between namespaces is never translated, even when it
+		// crosses the overlay
+		rule := []string{"-s", bridgeCidr, "!", "-d", bridgeCidr, "-j", "MASQUERADE"}
+		exists, err := table.Exists("nat", "POSTROUTING", rule...)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			if err = table.Append("nat", "POSTROUTING", rule...); err != nil {
+				return err
+			}
+
+			// inventory.go
+			inventory.record(Resource{
+				Kind:     ResourceRule,
+				Protocol: protocolName(protocol),
+				Table:    "nat",
+				Chain:    "POSTROUTING",
+				Rule:     rule,
+			})
+		}
+
+		// the policy applies to the whole host, so the old one is put back
+		// on shutdown
+		policy, err := chainPolicy(table, "filter", "FORWARD")
+		if err != nil {
+			return err
+		}
+
+		if policy != "ACCEPT" {
+			if err = table.ChangePolicy("filter", "FORWARD", "ACCEPT"); err != nil {
+				return err
+			}
+
+			inventory.record(Resource{
+				Kind:     ResourcePolicy,
+				Protocol: protocolName(protocol),
+				Table:    "filter",
+				Chain:    "FORWARD",
+				Policy:   policy,
+			})
+		}
+
+		// the FORWARD policy is moot for IPv6 until the host routes it at all
+		if protocol == iptables.ProtocolIPv6 {
+			if err := enableSysctl(IPv6ForwardingSysctl); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// enableSysctl sets the boolean sysctl at path, recording what it was so
+// that shutdown can put it back
+func enableSysctl(path string) error {
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
 		return err
 	}
 
-	if err = table.ChangePolicy("filter", "FORWARD", "ACCEPT"); err != nil {
+	value := strings.TrimSpace(string(old))
+	if value == "1" {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path, []byte("1\n"), 0644); err != nil {
 		return err
 	}
 
+	// inventory.go
+	inventory.record(Resource{Kind: ResourceSysctl, Name: path, Value: value})
 	return nil
 }
 
@@ -501,8 +728,15 @@ func saveAndSwapNetNs(oldns, newns netns.NsHandle, saveLocation string) error {
 	}
 	tempfile.Close()
 
+	// inventory.go; cleanup may run from anywhere
+	path, err := filepath.Abs(saveLocation)
+	if err != nil {
+		return err
+	}
+	inventory.record(Resource{Kind: ResourceMount, Name: path})
+
 	if err = mount.Mount(nsloc, saveLocation, "", "bind"); err != nil {
-		fmt.Println(err)
+		logger.WithError(err).WithField("path", saveLocation).Error("unable to save namespace")
 		return err
 	}
 	
@@ -530,5 +764,10 @@ func restoreOldNs(saveLocation string) error {
 		return err
 	}
 
+	// inventory.go
+	if path, err := filepath.Abs(saveLocation); err == nil {
+		inventory.forget(ResourceMount, path)
+	}
+
 	return nil
 }